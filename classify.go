@@ -0,0 +1,200 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// classifyAnalysisSize is the longest edge images are scaled down to before
+// their colors are counted
+const classifyAnalysisSize = 512
+
+// Hue ranges in degrees of the branding colors. Powerball prints red, Mega
+// Millions blue with gold
+const (
+	redHueLow   = 340.0 // Red wraps around 0
+	redHueHigh  = 15.0
+	goldHueLow  = 35.0
+	goldHueHigh = 60.0
+	blueHueLow  = 200.0
+	blueHueHigh = 255.0
+)
+
+// Pixels count as branding colors when saturated and bright enough, which leaves
+// out the paper, the print and most table tops
+const (
+	minBrandSaturation = 0.4
+	minBrandValue      = 80
+)
+
+// fullColorEvidence is the share of branding-colored pixels, in percent, from
+// which the colors count as fully as the text
+const fullColorEvidence = 2.0
+
+// Weights of the color and text evidence in the logit of the Powerball probability
+const (
+	colorEvidenceWeight = 3.0
+	textEvidenceWeight  = 4.0
+)
+
+// gameKeywords maps words printed on tickets to the game they belong to
+var gameKeywords = map[string]string{
+	"POWERBALL": "powerball",
+	"POWER":     "powerball",
+	"PB":        "powerball",
+	"DOUBLE":    "powerball",
+	"MEGA":      "megamillions",
+	"MILLIONS":  "megamillions",
+	"MB":        "megamillions",
+	"MEGAPLIER": "megamillions",
+}
+
+// classifyGame guesses which game the ticket in img belongs to from the share of
+// red against blue and gold pixels, and from game words read off the ticket such
+// as the PB or MB tag in front of the last number of every play line
+func classifyGame(img image.Image) GameClassification {
+	return classifyGameLines(img, readTextLines(analyzeText(img, nil)))
+}
+
+// classifyGameLines is classifyGame with the text of img already read into lines
+func classifyGameLines(img image.Image, lines []ticketLine) GameClassification {
+	small := toRGBA(scaleToFit(img, classifyAnalysisSize, classifyAnalysisSize, draw.ApproxBiLinear))
+	width, height := small.Bounds().Dx(), small.Bounds().Dy()
+
+	red, gold, blue, colorful := 0, 0, 0, 0
+	for y := 0; y < height; y++ {
+		row := small.Pix[y*small.Stride : y*small.Stride+width*4]
+		for x := 0; x < width; x++ {
+			r, g, b := int(row[x*4]), int(row[x*4+1]), int(row[x*4+2])
+			high, low := max(r, g, b), min(r, g, b)
+			if high < minBrandValue || float64(high-low) < minBrandSaturation*float64(high) {
+				continue
+			}
+			colorful++
+			switch hue := pixelHue(r, g, b, high, low); {
+			case hue >= redHueLow || hue < redHueHigh:
+				red++
+			case hue >= goldHueLow && hue < goldHueHigh:
+				gold++
+			case hue >= blueHueLow && hue < blueHueHigh:
+				blue++
+			}
+		}
+	}
+	pixels := float64(width * height)
+	classification := GameClassification{
+		RedPercent:  roundAssessment(100 * float64(red) / pixels),
+		BluePercent: roundAssessment(100 * float64(blue) / pixels),
+		GoldPercent: roundAssessment(100 * float64(gold) / pixels),
+		Keywords:    []string{},
+	}
+
+	logit := 0.0
+	if branded := red + gold + blue; branded > 0 {
+		// Colors spread over the whole hue circle, as in a busy background, say
+		// little about the branding
+		colorScore := float64(red-gold-blue) / float64(branded)
+		strength := math.Min(1, 100*float64(branded)/pixels/fullColorEvidence) * float64(branded) / float64(colorful)
+		logit += colorEvidenceWeight * colorScore * strength
+	}
+
+	powerball, megaMillions := 0, 0
+	for _, keyword := range readGameKeywords(lines) {
+		classification.Keywords = append(classification.Keywords, keyword)
+		if gameKeywords[keyword] == "powerball" {
+			powerball++
+		} else {
+			megaMillions++
+		}
+	}
+	if hits := powerball + megaMillions; hits > 0 {
+		textScore := float64(powerball-megaMillions) / float64(hits)
+		logit += textEvidenceWeight * textScore * math.Min(1, float64(hits)/2)
+	}
+
+	if logit == 0 {
+		classification.Game = "unknown"
+		return classification
+	}
+	probability := 1 / (1 + math.Exp(-logit))
+	classification.Game = "powerball"
+	if probability < 0.5 {
+		classification.Game = "megamillions"
+		probability = 1 - probability
+	}
+	classification.Confidence = math.Round(probability*1000) / 1000
+	return classification
+}
+
+// pixelHue returns the hue of an RGB color in degrees, given its largest and
+// smallest channel
+func pixelHue(r, g, b, high, low int) float64 {
+	spread := float64(high - low)
+	var hue float64
+	switch high {
+	case r:
+		hue = float64(g-b) / spread
+	case g:
+		hue = 2 + float64(b-r)/spread
+	default:
+		hue = 4 + float64(r-g)/spread
+	}
+	hue *= 60
+	if hue < 0 {
+		hue += 360
+	}
+	return hue
+}
+
+// readGameKeywords returns the game words found in the text lines, each at most
+// once and sorted. Digits that terminal fonts draw like letters are read as those
+// letters, and words of five letters or more may have one typo
+func readGameKeywords(lines []ticketLine) []string {
+	found := make(map[string]bool)
+	for _, line := range lines {
+		for i := range line.Words {
+			for _, token := range strings.FieldsFunc(lettersForDigits.Replace(line.text(i)), func(r rune) bool { return r < 'A' || r > 'Z' }) {
+				for keyword := range gameKeywords {
+					if token == keyword || (len(keyword) >= 5 && editDistance(token, keyword) <= 1) {
+						found[keyword] = true
+					}
+				}
+			}
+		}
+	}
+
+	keywords := make([]string, 0, len(found))
+	for keyword := range found {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	return keywords
+}
+
+// lettersForDigits swaps digits for the letters they are mistaken for
+var lettersForDigits = strings.NewReplacer("0", "O", "1", "I", "5", "S", "8", "B")
+
+// editDistance returns the Levenshtein distance between two ASCII strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageExtensions lists the file extensions picked up when a directory is processed
+var imageExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".bmp": true, ".tif": true, ".tiff": true, ".webp": true,
+}
+
+// processJob is a single image file processed by the process command
+type processJob struct {
+	Input  string
+	Output string // Output path without the extension, which follows the output format
+}
+
+// runProcessCommand implements the "process" subcommand, which runs the contrast
+// adjustment or an operation pipeline over image files without starting the server
+// It returns the exit code of the command
+func runProcessCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("process", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: contrast-adjuster process [flags] <file or directory>...")
+		flags.PrintDefaults()
+	}
+	contrast := flags.Float64("contrast", 0, "contrast factor for the linear mode")
+	mode := flags.String("mode", "", "contrast mode: linear, luminance, sigmoid, auto or binarize")
+	optionsJSON := flags.String("options", "", "contrast settings as JSON, same fields as /adjust-contrast")
+	opsJSON := flags.String("ops", "", "operation pipeline as a JSON array, same as /process-image, or @file to read it from a file")
+	format := flags.String("format", "", "output format: png or jpeg (default: jpeg for JPEG input, png otherwise)")
+	quality := flags.Int("quality", 0, "JPEG quality from 1 to 100")
+	outDir := flags.String("out", "", "directory to write outputs to (default: next to each input)")
+	suffix := flags.String("suffix", "_processed", "suffix added to output file names")
+	workers := flags.Int("workers", runtime.GOMAXPROCS(0), "number of files processed at the same time")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	process, err := processCommandFunc(*contrast, *mode, *optionsJSON, *opsJSON, OutputOptions{OutputFormat: *format, JPEGQuality: *quality})
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return 2
+	}
+
+	jobs, err := collectProcessJobs(flags.Args(), *outDir, *suffix)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return 1
+	}
+	if len(jobs) == 0 {
+		fmt.Fprintln(stderr, "Error: no image files found")
+		return 1
+	}
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0o755); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return 1
+		}
+	}
+
+	start := time.Now()
+	var mu sync.Mutex
+	done, failed := 0, 0
+	queue := make(chan processJob)
+	var wg sync.WaitGroup
+	for w := 0; w < max(1, min(*workers, len(jobs))); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				jobStart := time.Now()
+				output, err := processFile(job, process)
+
+				mu.Lock()
+				done++
+				if err != nil {
+					failed++
+					fmt.Fprintf(stdout, "[%d/%d] FAILED %s: %v\n", done, len(jobs), job.Input, err)
+				} else {
+					fmt.Fprintf(stdout, "[%d/%d] %s -> %s (%d ms)\n", done, len(jobs), job.Input, output, time.Since(jobStart).Milliseconds())
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	fmt.Fprintf(stdout, "Processed %d files in %.1fs: %d succeeded, %d failed\n",
+		len(jobs), time.Since(start).Seconds(), len(jobs)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// processCommandFunc validates the processing flags and returns the function run
+// over the bytes of every file. An operation pipeline and contrast settings cannot
+// be combined
+func processCommandFunc(contrast float64, mode, optionsJSON, opsJSON string, outputOptions OutputOptions) (func([]byte) (*processedImage, error), error) {
+	if opsJSON != "" {
+		if contrast != 0 || mode != "" || optionsJSON != "" {
+			return nil, fmt.Errorf("-ops cannot be combined with -contrast, -mode or -options")
+		}
+		if strings.HasPrefix(opsJSON, "@") {
+			data, err := os.ReadFile(opsJSON[1:])
+			if err != nil {
+				return nil, err
+			}
+			opsJSON = string(data)
+		}
+		var operations []ImageOperation
+		if err := json.Unmarshal([]byte(opsJSON), &operations); err != nil {
+			return nil, fmt.Errorf("invalid -ops: %w", err)
+		}
+		steps, err := buildPipeline(operations)
+		if err != nil {
+			return nil, err
+		}
+		output, err := newImageOutput(outputOptions, false)
+		if err != nil {
+			return nil, err
+		}
+		return func(data []byte) (*processedImage, error) {
+			return processImageBytes(data, output, steps)
+		}, nil
+	}
+
+	var options ContrastOptions
+	if optionsJSON != "" {
+		if err := json.Unmarshal([]byte(optionsJSON), &options); err != nil {
+			return nil, fmt.Errorf("invalid -options: %w", err)
+		}
+	}
+	if contrast != 0 {
+		options.ContrastFactor = contrast
+	}
+	if mode != "" {
+		options.Mode = mode
+	}
+	if outputOptions.OutputFormat != "" {
+		options.OutputFormat = outputOptions.OutputFormat
+	}
+	if outputOptions.JPEGQuality != 0 {
+		options.JPEGQuality = outputOptions.JPEGQuality
+	}
+	// Validate the settings once up front instead of failing every file
+	if _, err := contrastSteps(options); err != nil {
+		return nil, err
+	}
+	if _, err := newImageOutput(options.OutputOptions, options.KeepMetadata); err != nil {
+		return nil, err
+	}
+	return func(data []byte) (*processedImage, error) {
+		processed, _, err := adjustContrast(data, options, "")
+		return processed, err
+	}, nil
+}
+
+// collectProcessJobs expands the command arguments into image files and works out
+// where the output of each one goes. Directories contribute the image files
+// directly inside them
+func collectProcessJobs(paths []string, outDir, suffix string) ([]processJob, error) {
+	if suffix == "" && outDir == "" {
+		return nil, fmt.Errorf("an empty -suffix needs -out set to another directory, or the inputs would be overwritten")
+	}
+
+	var inputs []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			inputs = append(inputs, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			// Skip the outputs of earlier runs
+			if suffix != "" && strings.HasSuffix(strings.TrimSuffix(name, filepath.Ext(name)), suffix) {
+				continue
+			}
+			if entry.Type().IsRegular() && imageExtensions[strings.ToLower(filepath.Ext(name))] {
+				inputs = append(inputs, filepath.Join(path, name))
+			}
+		}
+	}
+	sort.Strings(inputs)
+
+	jobs := make([]processJob, 0, len(inputs))
+	seen := make(map[string]string)
+	for _, input := range inputs {
+		base := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)) + suffix
+		dir := filepath.Dir(input)
+		if outDir != "" {
+			dir = outDir
+		}
+		output := filepath.Join(dir, base)
+		if overwritesInput(input, output) {
+			return nil, fmt.Errorf("%s would be overwritten by its own output, use another -out directory or -suffix", input)
+		}
+		if other, ok := seen[output]; ok {
+			return nil, fmt.Errorf("%s and %s would both be written to %s", other, input, output)
+		}
+		seen[output] = input
+		jobs = append(jobs, processJob{Input: input, Output: output})
+	}
+	return jobs, nil
+}
+
+// overwritesInput reports whether writing output, with either of the extensions
+// processFile picks, would replace the file input
+func overwritesInput(input, output string) bool {
+	inputPath, err := filepath.Abs(input)
+	if err != nil {
+		return false
+	}
+	for _, extension := range []string{".png", ".jpg"} {
+		if outputPath, err := filepath.Abs(output + extension); err == nil && outputPath == inputPath {
+			return true
+		}
+	}
+	return false
+}
+
+// processFile runs process over a single input file and writes the result,
+// returning the path of the written file
+func processFile(job processJob, process func([]byte) (*processedImage, error)) (string, error) {
+	data, err := os.ReadFile(job.Input)
+	if err != nil {
+		return "", err
+	}
+	processed, err := process(data)
+	if err != nil {
+		var imgErr *imageError
+		if errors.As(err, &imgErr) {
+			return "", fmt.Errorf("%s (%s)", imgErr.Message, imgErr.Code)
+		}
+		return "", err
+	}
+
+	extension := ".png"
+	if processed.MimeType == "image/jpeg" {
+		extension = ".jpg"
+	}
+	output := job.Output + extension
+	if err := os.WriteFile(output, processed.Data, 0o644); err != nil {
+		return "", err
+	}
+	return output, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCollectProcessJobsEmptySuffix(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	input := filepath.Join(in, "a.png")
+	if err := os.WriteFile(input, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without -out the input would be written over, for files and directories
+	for _, path := range []string{input, in} {
+		if _, err := collectProcessJobs([]string{path}, "", ""); err == nil {
+			t.Errorf("%s: expected an error for an empty suffix without -out", path)
+		}
+	}
+	// Pointing -out at the input directory does not help
+	if _, err := collectProcessJobs([]string{in}, in, ""); err == nil {
+		t.Errorf("expected an error for an output in place of the input")
+	}
+
+	// Another directory takes every image of the input directory
+	jobs, err := collectProcessJobs([]string{in}, out, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Input != input || jobs[0].Output != filepath.Join(out, "a") {
+		t.Errorf("got jobs %+v, want %s written to %s", jobs, input, filepath.Join(out, "a"))
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// digitCharset limits glyph matching to digits where a number is expected
+const digitCharset = "0123456789"
+
+// Match quality of a digit that counts as certain. The confidence of a digit
+// falls off linearly below either
+const (
+	certainDigitScore  = 0.8
+	certainDigitMargin = 0.2
+)
+
+// Month names as printed on tickets, in calendar order
+var monthAbbreviations = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+// monthDatePattern matches dates with the month written out, such as "AUG 27 25"
+// or "AUG27, 2025"
+var monthDatePattern = regexp.MustCompile(`\b(JAN|FEB|MAR|APR|MAY|JUN|JUL|AUG|SEP|OCT|NOV|DEC)[A-Z]* ?(\d{1,2}),? (\d{2}|\d{4})\b`)
+
+// multiplierPattern matches multipliers such as 3X, allowing digits read as letters
+var multiplierPattern = regexp.MustCompile(`^([0-9OISBZ]{1,2})X$`)
+
+// readTicket reads the play lines of a ticket printed by a lottery terminal and
+// returns them in the structure the extraction prompt asks the vision model for
+// Numbers are read with the digit templates only, and every number reports the
+// confidence of its least certain digit
+func readTicket(img image.Image) ReadTicketResponse {
+	bounds := img.Bounds()
+	// The text is laid out and read once for both the plays and the game
+	segments := segmentTicket(analyzeText(img, nil))
+	classification := classifyGameLines(img, segments.Lines)
+
+	response := ReadTicketResponse{
+		Numbers:     [][]string{},
+		Multipliers: []string{},
+		Lines:       []ReadPlayLine{},
+		Confidence:  1,
+	}
+	balls := []string{}
+	for _, play := range segments.Plays {
+		line := readPlayLine(segments.Layout.Binary, play)
+		line.ImageRegion = imageRegion(scaleRect(play.Line.Box, 1/segments.Layout.Scale).Add(bounds.Min).Intersect(bounds), bounds, "")
+
+		values := make([]string, len(line.Numbers))
+		for j, number := range line.Numbers {
+			values[j] = number.Value
+			response.Confidence = math.Min(response.Confidence, number.Confidence)
+		}
+		response.Numbers = append(response.Numbers, values)
+		if line.Ball != nil {
+			balls = append(balls, line.Ball.Value)
+			response.Confidence = math.Min(response.Confidence, line.Ball.Confidence)
+		}
+		response.Lines = append(response.Lines, line)
+	}
+	if len(response.Lines) == 0 {
+		response.Confidence = 0
+	}
+
+	// The ball goes under the game of the ticket only, as the prompt asks
+	switch classification.Game {
+	case "powerball":
+		response.TicketType = "powerball"
+		response.PB = &balls
+	case "megamillions":
+		response.TicketType = "megamillions"
+		response.MB = &balls
+	}
+
+	for _, line := range segments.DateLines {
+		if date := readDrawDate(line); date != "" {
+			response.DrawDate = date
+			break
+		}
+	}
+	for _, line := range segments.Lines {
+		readTicketOptions(line, &response)
+	}
+	return response
+}
+
+// readPlayLine reads the numbers of a play line and the ball after the PB or MB
+// tag. Without a tag the sixth number is taken as the ball
+func readPlayLine(binary *image.Paletted, play ticketPlay) ReadPlayLine {
+	line := ReadPlayLine{Label: play.Label, Numbers: []ReadNumber{}}
+	tagged := false
+	for i := play.First; i < len(play.Words); i++ {
+		word := play.Line.Words[i]
+		text := play.text(i)
+		if !isPlayNumber(text) {
+			if len(line.Numbers) > 0 && line.Ball == nil {
+				tagged = true
+			}
+			continue
+		}
+		number := readNumber(readWord(binary, play.Line, word, digitCharset))
+		switch {
+		case tagged && line.Ball == nil:
+			line.Ball = &number
+		case !tagged:
+			line.Numbers = append(line.Numbers, number)
+		}
+	}
+	if !tagged && len(line.Numbers) > minPlayNumbers {
+		ball := line.Numbers[minPlayNumbers]
+		line.Ball = &ball
+		line.Numbers = line.Numbers[:minPlayNumbers]
+	}
+	return line
+}
+
+// readNumber turns the digit matches of a number into its value, padded to two
+// digits as printed on tickets, and the confidence of every digit
+func readNumber(matches []glyphMatch) ReadNumber {
+	number := ReadNumber{Confidence: 1, DigitConfidence: []float64{}}
+	var value strings.Builder
+	for _, match := range matches {
+		if !unicode.IsDigit(match.Char) {
+			continue
+		}
+		confidence := digitConfidence(match)
+		value.WriteRune(match.Char)
+		number.DigitConfidence = append(number.DigitConfidence, confidence)
+		number.Confidence = math.Min(number.Confidence, confidence)
+	}
+	number.Value = value.String()
+	if len(number.Value) == 1 {
+		number.Value = "0" + number.Value
+	}
+	return number
+}
+
+// digitConfidence rates a digit match from 0 to 1 by how well it fits its
+// template and how far it leads the next best digit
+func digitConfidence(match glyphMatch) float64 {
+	fit := math.Min(1, math.Max(0, match.Score/certainDigitScore))
+	lead := math.Min(1, math.Max(0, match.Margin/certainDigitMargin))
+	return math.Round(fit*lead*1000) / 1000
+}
+
+// normalizedText joins the words of line with single spaces, reading words that
+// are mostly digits as digits and the others as letters
+func normalizedText(line ticketLine) string {
+	words := make([]string, len(line.Words))
+	for i := range line.Words {
+		text := line.text(i)
+		digits := 0
+		for _, r := range text {
+			if unicode.IsDigit(r) {
+				digits++
+			}
+		}
+		if 2*digits > len(text) {
+			words[i] = digitsForLetters.Replace(text)
+		} else {
+			words[i] = lettersForDigits.Replace(text)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// readDrawDate returns the first date read in line as YYYY-MM-DD, or an empty
+// string. Numeric dates are taken as month first unless they start with the year
+func readDrawDate(line ticketLine) string {
+	for i := range line.Words {
+		text := digitsForLetters.Replace(line.text(i))
+		if !datePattern.MatchString(text) {
+			continue
+		}
+		parts := strings.FieldsFunc(text, func(r rune) bool { return r == '/' || r == '-' })
+		if len(parts[0]) == 4 {
+			parts = []string{parts[1], parts[2], parts[0]}
+		}
+		if date := formatDate(parts[0], parts[1], parts[2]); date != "" {
+			return date
+		}
+	}
+
+	if found := monthDatePattern.FindStringSubmatch(normalizedText(line)); found != nil {
+		for month, abbreviation := range monthAbbreviations {
+			if found[1] == abbreviation {
+				return formatDate(strconv.Itoa(month+1), found[2], found[3])
+			}
+		}
+	}
+	return ""
+}
+
+// formatDate formats a month, day and year of two or four digits as YYYY-MM-DD,
+// or returns an empty string when they do not make a date
+func formatDate(month, day, year string) string {
+	m, errM := strconv.Atoi(month)
+	d, errD := strconv.Atoi(day)
+	y, errY := strconv.Atoi(year)
+	if errM != nil || errD != nil || errY != nil {
+		return ""
+	}
+	if len(year) == 2 {
+		y += 2000
+	}
+	date := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	if date.Month() != time.Month(m) || date.Day() != d {
+		return ""
+	}
+	return date.Format("2006-01-02")
+}
+
+// readTicketOptions sets the Power Play, Double Play and multipliers printed in
+// line. An option counts as bought unless its name is followed by NO
+// The Megaplier of Mega Millions tickets is reported as powerplay
+func readTicketOptions(line ticketLine, response *ReadTicketResponse) {
+	tokens := strings.Fields(normalizedText(line))
+	bought := func(next int) bool {
+		return next >= len(tokens) || tokens[next] != "NO"
+	}
+	for i, token := range tokens {
+		switch {
+		case fuzzyEqual(token, "POWERPLAY") || fuzzyEqual(token, "MEGAPLIER"):
+			response.PowerPlay = bought(i + 1)
+		case fuzzyEqual(token, "POWER") && i+1 < len(tokens) && playWord(tokens[i+1]):
+			response.PowerPlay = bought(i + 2)
+		case fuzzyEqual(token, "DOUBLE") && i+1 < len(tokens) && playWord(tokens[i+1]):
+			response.DoublePlay = bought(i + 2)
+		}
+	}
+
+	for i := range line.Words {
+		if found := multiplierPattern.FindStringSubmatch(line.text(i)); found != nil {
+			multiplier := fmt.Sprintf("%sX", strings.TrimLeft(digitsForLetters.Replace(found[1]), "0"))
+			if multiplier != "X" && !containsString(response.Multipliers, multiplier) {
+				response.Multipliers = append(response.Multipliers, multiplier)
+			}
+		}
+	}
+}
+
+// fuzzyEqual reports whether a word read off a ticket is the given word, allowing
+// one typo in words of five letters or more
+func fuzzyEqual(token, word string) bool {
+	return token == word || (len(word) >= 5 && editDistance(token, word) <= 1)
+}
+
+// playWord reports whether a word read off a ticket is PLAY. Two typos are
+// allowed since L and A often run together, while BALL is still kept apart
+func playWord(token string) bool {
+	return editDistance(token, "PLAY") <= 2
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// readLine builds a ticket line whose words read as the space separated words of text
+func readLine(text string) ticketLine {
+	var line ticketLine
+	for _, word := range strings.Fields(text) {
+		var matches []glyphMatch
+		for _, r := range word {
+			matches = append(matches, glyphMatch{Char: r, Score: 1, Margin: 1})
+		}
+		line.Words = append(line.Words, matches)
+	}
+	return line
+}
+
+func TestFormatDate(t *testing.T) {
+	tests := []struct {
+		month, day, year string
+		want             string
+	}{
+		{"08", "27", "25", "2025-08-27"},
+		{"8", "27", "2025", "2025-08-27"},
+		{"12", "31", "1999", "1999-12-31"},
+		{"02", "29", "24", "2024-02-29"},
+		{"02", "29", "25", ""},
+		{"13", "01", "25", ""},
+		{"00", "10", "25", ""},
+		{"04", "31", "25", ""},
+		{"AU", "27", "25", ""},
+	}
+	for _, tt := range tests {
+		if got := formatDate(tt.month, tt.day, tt.year); got != tt.want {
+			t.Errorf("formatDate(%q, %q, %q) = %q, want %q", tt.month, tt.day, tt.year, got, tt.want)
+		}
+	}
+}
+
+func TestReadDrawDate(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"DRAW DATE 08/27/25", "2025-08-27"},
+		{"2025-08-27", "2025-08-27"},
+		{"O8/Z7/Z5", "2025-08-27"},
+		{"WED AUG 27 25", "2025-08-27"},
+		{"AUG27, 2025", "2025-08-27"},
+		{"SAT SEP 6 2025", "2025-09-06"},
+		{"02/30/25 SAT AUG 30 25", "2025-08-30"},
+		{"13/45/25 DRAW", ""},
+		{"POWERBALL", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := readDrawDate(readLine(tt.text)); got != tt.want {
+			t.Errorf("readDrawDate(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPlayLine(t *testing.T) {
+	tests := []struct {
+		text  string
+		ok    bool
+		label string
+		first int
+	}{
+		{"A. 05 12 23 34 45 PB 10", true, "A", 1},
+		{"B) 05 12 23 34 45 PB 10", true, "B", 1},
+		{"05 12 23 34 45 10", true, "", 0},
+		{"D 05 12 23 34 45", true, "D", 1},      // A label that reads as a number
+		{"B 12 23 34 45 PB 10", true, "", 0},    // An 8 read as B, not a label
+		{"A. 05 12 123 34 45 56", true, "A", 1}, // Not a number, so a label
+		{"05 12 23 34", false, "", 0},
+		{"POWER PLAY 2X", false, "", 0},
+	}
+	for _, tt := range tests {
+		play, ok := playLine(readLine(tt.text))
+		if ok != tt.ok || play.Label != tt.label || play.First != tt.first {
+			t.Errorf("playLine(%q) = label %q from word %d, %v, want label %q from word %d, %v", tt.text, play.Label, play.First, ok, tt.label, tt.first, tt.ok)
+		}
+	}
+}
+
+func TestIsPlayNumber(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"7", true},
+		{"05", true},
+		{"O5", true},
+		{"SB", true},
+		{"123", false},
+		{"", false},
+		{"X", false},
+		{"5X", false},
+		{"-1", false},
+	}
+	for _, tt := range tests {
+		if got := isPlayNumber(tt.text); got != tt.want {
+			t.Errorf("isPlayNumber(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"PLAY", "PLAY", 0},
+		{"PLAY", "", 4},
+		{"", "ABC", 3},
+		{"POWERBALL", "P0WERBALL", 1},
+		{"MEGAPLIER", "MEGAPLER", 1},
+		{"PB", "MB", 1},
+		{"ABC", "CBA", 2},
+		{"KITTEN", "SITTING", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
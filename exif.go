@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// JPEG markers used while walking the segments of a file
+const (
+	jpegMarkerSOI  = 0xD8
+	jpegMarkerEOI  = 0xD9
+	jpegMarkerSOS  = 0xDA
+	jpegMarkerAPP1 = 0xE1
+)
+
+// exifOrientationTag is the TIFF tag holding the EXIF orientation
+const exifOrientationTag = 0x0112
+
+// exifHeader starts the APP1 payload of a segment holding EXIF data
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifData is the EXIF block found in a JPEG file
+type exifData struct {
+	payload           []byte           // APP1 payload including the "Exif\0\0" header
+	byteOrder         binary.ByteOrder // Byte order of the TIFF structure
+	orientation       int              // Orientation tag value, 1 when absent
+	orientationOffset int              // Offset of the orientation value in payload, -1 when absent
+}
+
+// readExif extracts the EXIF block from the APP1 segments of a JPEG file
+// It returns nil for other formats and for JPEGs without EXIF data
+func readExif(data []byte) *exifData {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegMarkerSOI {
+		return nil
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == jpegMarkerSOS || marker == jpegMarkerEOI {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil
+		}
+		payload := data[i+4 : i+2+length]
+		if marker == jpegMarkerAPP1 && bytes.HasPrefix(payload, exifHeader) {
+			return parseExif(payload)
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// parseExif reads the orientation from the first IFD of an EXIF payload
+func parseExif(payload []byte) *exifData {
+	exif := &exifData{payload: payload, orientation: 1, orientationOffset: -1}
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return exif
+	}
+
+	switch string(tiff[:2]) {
+	case "II":
+		exif.byteOrder = binary.LittleEndian
+	case "MM":
+		exif.byteOrder = binary.BigEndian
+	default:
+		return exif
+	}
+	if exif.byteOrder.Uint16(tiff[2:]) != 42 {
+		return exif
+	}
+
+	offset := exif.byteOrder.Uint32(tiff[4:])
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return exif
+	}
+	ifd := int(offset)
+	entries := int(exif.byteOrder.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if exif.byteOrder.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(exif.byteOrder.Uint16(tiff[entry+8:]))
+			if orientation >= 1 && orientation <= 8 {
+				exif.orientation = orientation
+				exif.orientationOffset = len(exifHeader) + entry + 8
+			}
+			break
+		}
+	}
+	return exif
+}
+
+// uprightPayload returns a copy of the EXIF payload with the orientation reset to
+// normal, for images whose pixels have already been turned upright
+func (e *exifData) uprightPayload() []byte {
+	payload := append([]byte(nil), e.payload...)
+	if e.orientationOffset >= 0 {
+		e.byteOrder.PutUint16(payload[e.orientationOffset:], 1)
+	}
+	return payload
+}
+
+// insertExif adds an APP1 segment holding payload right after the start marker
+// of an encoded JPEG
+func insertExif(jpegData, payload []byte) []byte {
+	if len(jpegData) < 2 || len(payload)+2 > 0xFFFF {
+		return jpegData
+	}
+	segment := make([]byte, 4, 4+len(payload))
+	segment[0], segment[1] = 0xFF, jpegMarkerAPP1
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := make([]byte, 0, len(jpegData)+len(segment))
+	out = append(out, jpegData[:2]...)
+	out = append(out, segment...)
+	return append(out, jpegData[2:]...)
+}
+
+// applyOrientation rotates and flips img so it displays upright for the given
+// EXIF orientation value
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	src := toRGBA(img)
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	// source returns the source pixel that lands on destination pixel (x, y)
+	source := func(x, y int) (int, int) {
+		switch orientation {
+		case 2: // Mirrored horizontally
+			return width - 1 - x, y
+		case 3: // Rotated 180 degrees
+			return width - 1 - x, height - 1 - y
+		case 4: // Mirrored vertically
+			return x, height - 1 - y
+		case 5: // Mirrored along the main diagonal
+			return y, x
+		case 6: // Needs a 90 degree clockwise turn
+			return y, height - 1 - x
+		case 7: // Mirrored along the anti-diagonal
+			return width - 1 - y, height - 1 - x
+		default: // Needs a 90 degree counterclockwise turn
+			return width - 1 - y, x
+		}
+	}
+
+	parallelRows(dstHeight, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < dstWidth; x++ {
+				sx, sy := source(x, y)
+				copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+			}
+		}
+	})
+	return dst
+}
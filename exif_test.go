@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// exifJPEG builds the start of a JPEG file whose APP1 segment holds a TIFF
+// structure in the given byte order with a single orientation entry
+func exifJPEG(order binary.ByteOrder, orientation int) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifOrientationTag)
+	order.PutUint16(tiff[12:], 3) // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+
+	payload := append(append([]byte(nil), exifHeader...), tiff...)
+	data := []byte{0xFF, jpegMarkerSOI, 0xFF, jpegMarkerAPP1, 0, 0}
+	binary.BigEndian.PutUint16(data[4:], uint16(len(payload)+2))
+	data = append(data, payload...)
+	return append(data, 0xFF, jpegMarkerEOI)
+}
+
+func TestReadExifByteOrder(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		exif := readExif(exifJPEG(order, 6))
+		if exif == nil {
+			t.Fatalf("%v: no EXIF data found", order)
+		}
+		if exif.byteOrder != order || exif.orientation != 6 {
+			t.Errorf("%v: got byte order %v and orientation %d, want orientation 6", order, exif.byteOrder, exif.orientation)
+		}
+
+		upright := parseExif(exif.uprightPayload())
+		if upright.orientation != 1 || upright.orientationOffset != exif.orientationOffset {
+			t.Errorf("%v: upright payload has orientation %d at %d, want 1 at %d", order, upright.orientation, upright.orientationOffset, exif.orientationOffset)
+		}
+		if parseExif(exif.payload).orientation != 6 {
+			t.Errorf("%v: uprightPayload changed the original payload", order)
+		}
+	}
+}
+
+func TestReadExifMalformed(t *testing.T) {
+	valid := exifJPEG(binary.BigEndian, 6)
+	corrupt := func(offset int, values ...byte) []byte {
+		data := append([]byte(nil), valid...)
+		copy(data[offset:], values)
+		return data
+	}
+	tiff := 6 + len(exifHeader) // Offset of the TIFF structure in valid
+
+	tests := []struct {
+		name    string
+		data    []byte
+		found   bool
+		wantOri int
+	}{
+		{"empty", nil, false, 0},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), false, 0},
+		{"garbage after SOI", []byte{0xFF, jpegMarkerSOI, 0x12, 0x34, 0x56, 0x78}, false, 0},
+		{"segment length too short", corrupt(4, 0, 1), false, 0},
+		{"segment longer than file", corrupt(4, 0xFF, 0xFF), false, 0},
+		{"APP1 without EXIF header", corrupt(6, 'X'), false, 0},
+		{"unknown byte order", corrupt(tiff, 'X', 'X'), true, 1},
+		{"bad TIFF magic", corrupt(tiff+2, 0, 43), true, 1},
+		{"IFD offset past the end", corrupt(tiff+4, 0xFF, 0xFF, 0xFF, 0xFF), true, 1},
+		{"more entries than data", corrupt(tiff+8, 0xFF, 0xFF, 0xAA, 0xAA), true, 1},
+		{"orientation out of range", corrupt(tiff+18, 0, 9), true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exif := readExif(tt.data)
+			if (exif != nil) != tt.found {
+				t.Fatalf("got %v, want found = %v", exif, tt.found)
+			}
+			if exif != nil && (exif.orientation != tt.wantOri || exif.orientationOffset != -1) {
+				t.Errorf("got orientation %d at %d, want %d and no offset", exif.orientation, exif.orientationOffset, tt.wantOri)
+			}
+		})
+	}
+
+	// Every truncation of a valid file is either rejected or read without panicking
+	for n := range valid {
+		if exif := readExif(valid[:n]); exif != nil && exif.orientation != 1 && exif.orientation != 6 {
+			t.Errorf("truncated to %d bytes: got orientation %d", n, exif.orientation)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// Source pixels, 3 wide and 2 high:
+	//   a b c
+	//   d e f
+	const a, b, c, d, e, f = 10, 20, 30, 40, 50, 60
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	copy(src.Pix, []uint8{a, b, c, d, e, f})
+
+	tests := []struct {
+		orientation int
+		want        [][]uint8 // Rows of the upright image
+	}{
+		{1, [][]uint8{{a, b, c}, {d, e, f}}},
+		{2, [][]uint8{{c, b, a}, {f, e, d}}},
+		{3, [][]uint8{{f, e, d}, {c, b, a}}},
+		{4, [][]uint8{{d, e, f}, {a, b, c}}},
+		{5, [][]uint8{{a, d}, {b, e}, {c, f}}},
+		{6, [][]uint8{{d, a}, {e, b}, {f, c}}},
+		{7, [][]uint8{{f, c}, {e, b}, {d, a}}},
+		{8, [][]uint8{{c, f}, {b, e}, {a, d}}},
+	}
+	for _, tt := range tests {
+		got := applyOrientation(src, tt.orientation)
+		bounds := got.Bounds()
+		if bounds.Dx() != len(tt.want[0]) || bounds.Dy() != len(tt.want) {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", tt.orientation, bounds.Dx(), bounds.Dy(), len(tt.want[0]), len(tt.want))
+			continue
+		}
+		for y, row := range tt.want {
+			for x, want := range row {
+				if v := color.GrayModel.Convert(got.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y; v != want {
+					t.Errorf("orientation %d: pixel (%d, %d) = %d, want %d", tt.orientation, x, y, v, want)
+				}
+			}
+		}
+	}
+}
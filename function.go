@@ -6,76 +6,1269 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	_ "image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"math"
+	"net/http"
+	"runtime"
 	"strings"
+	"sync"
 
+	_ "golang.org/x/image/bmp"
 	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 // changeContrast processes the image
-func changeContrast(img image.Image, contrast float64) (*image.RGBA, error) {
+// The pixels are remapped in place on the Pix slice through a lookup table, with
+// the rows split into bands across a bounded pool of workers. Opaque 8-bit images
+// come back as RGBA, images with transparency as NRGBA and 16-bit images as NRGBA64
+func changeContrast(img image.Image, contrast float64) (image.Image, error) {
+	return mapChannels(img, contrastCurve(contrast)), nil
+}
+
+// contrastCurve scales normalized channel values around the 0.5 midpoint
+func contrastCurve(contrast float64) func(v float64) float64 {
+	return func(v float64) float64 {
+		return (v-0.5)*contrast + 0.5
+	}
+}
+
+// sigmoidCurve is an S-shaped contrast curve of the given strength centered on
+// midpoint. The curve is rescaled so black and white stay in place, which rolls
+// highlights and shadows off smoothly instead of clipping them
+func sigmoidCurve(strength, midpoint float64) func(v float64) float64 {
+	sigmoid := func(v float64) float64 {
+		return 1 / (1 + math.Exp(strength*(midpoint-v)))
+	}
+	low, high := sigmoid(0), sigmoid(1)
+	return func(v float64) float64 {
+		return (sigmoid(v) - low) / (high - low)
+	}
+}
+
+// luminanceContrast scales the contrast of the lightness channel only, leaving
+// the hue and saturation of colored ticket stock alone
+// space selects the luma channel of YCbCr ("ycbcr") or the CIELAB L channel ("lab")
+// Grayscale images stay grayscale and 16-bit images keep their precision as
+// Gray16 or NRGBA64, as in changeContrast
+func luminanceContrast(img image.Image, contrast float64, space string) image.Image {
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return mapChannels(img, contrastCurve(contrast))
+	}
+	if isHighBitDepth(img) {
+		return luminanceContrast16(img, contrast, space)
+	}
+
+	newImg, pixels := straightPixels(img)
+	bounds := pixels.Bounds()
+	rowBytes := bounds.Dx() * 4
+	lut := buildLUT(contrastCurve(contrast))
+
+	parallelRows(bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := pixels.Pix[y*pixels.Stride : y*pixels.Stride+rowBytes]
+			for i := 0; i+3 < len(row); i += 4 {
+				if space == "lab" {
+					l, a, b := rgbToLab(row[i], row[i+1], row[i+2])
+					l = math.Max(0, math.Min(100, (l-50)*contrast+50))
+					row[i], row[i+1], row[i+2] = labToRGB(l, a, b)
+					continue
+				}
+				yy, cb, cr := color.RGBToYCbCr(row[i], row[i+1], row[i+2])
+				row[i], row[i+1], row[i+2] = color.YCbCrToRGB(lut[yy], cb, cr)
+			}
+		}
+	})
+	return newImg
+}
+
+// luminanceContrast16 is luminanceContrast for 16-bit color images, computed in
+// floating point on a non-premultiplied NRGBA64 copy
+func luminanceContrast16(img image.Image, contrast float64, space string) *image.NRGBA64 {
+	newImg := toNRGBA64(img)
+	bounds := newImg.Bounds()
+	rowBytes := bounds.Dx() * 8
+	curve := contrastCurve(contrast)
+	clamp := func(v float64) float64 { return math.Max(0, math.Min(1, v)) }
+
+	parallelRows(bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := newImg.Pix[y*newImg.Stride : y*newImg.Stride+rowBytes]
+			for i := 0; i+7 < len(row); i += 8 {
+				var rgb [3]float64
+				for ch := range rgb {
+					rgb[ch] = float64(uint16(row[i+2*ch])<<8|uint16(row[i+2*ch+1])) / 0xffff
+				}
+				if space == "lab" {
+					l, a, b := linearToLab(srgbToLinear(rgb[0]), srgbToLinear(rgb[1]), srgbToLinear(rgb[2]))
+					l = math.Max(0, math.Min(100, (l-50)*contrast+50))
+					lr, lg, lb := labToLinear(l, a, b)
+					rgb = [3]float64{linearToSRGB(lr), linearToSRGB(lg), linearToSRGB(lb)}
+				} else {
+					// Keeping Cb and Cr moves every channel by the change in luma
+					luma := 0.299*rgb[0] + 0.587*rgb[1] + 0.114*rgb[2]
+					shift := clamp(curve(luma)) - luma
+					rgb = [3]float64{rgb[0] + shift, rgb[1] + shift, rgb[2] + shift}
+				}
+				for ch, v := range rgb {
+					out := uint16(math.Round(clamp(v) * 0xffff))
+					row[i+2*ch], row[i+2*ch+1] = uint8(out>>8), uint8(out)
+				}
+			}
+		}
+	})
+	return newImg
+}
+
+// srgbToLinear maps a normalized sRGB value to linear light
+func srgbToLinear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB maps linear light back to a normalized sRGB value
+func linearToSRGB(c float64) float64 {
+	if c <= 0.0031308 {
+		return c * 12.92
+	}
+	return 1.055*math.Pow(c, 1/2.4) - 0.055
+}
+
+// srgbLinear maps 8-bit sRGB values to linear light
+var srgbLinear = func() (table [256]float64) {
+	for v := range table {
+		table[v] = srgbToLinear(float64(v) / 255)
+	}
+	return table
+}()
+
+// D65 reference white used for CIELAB conversions
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+)
+
+// rgbToLab converts an sRGB color to CIELAB under a D65 white point
+func rgbToLab(r, g, b uint8) (float64, float64, float64) {
+	return linearToLab(srgbLinear[r], srgbLinear[g], srgbLinear[b])
+}
+
+// linearToLab converts a linear-light RGB color to CIELAB under a D65 white point
+func linearToLab(lr, lg, lb float64) (float64, float64, float64) {
+	x := (0.4124564*lr + 0.3575761*lg + 0.1804375*lb) / whiteX
+	y := (0.2126729*lr + 0.7151522*lg + 0.0721750*lb) / whiteY
+	z := (0.0193339*lr + 0.1191920*lg + 0.9503041*lb) / whiteZ
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// labToRGB converts a CIELAB color under a D65 white point back to sRGB,
+// clamping colors that fall outside the sRGB gamut
+func labToRGB(l, a, b float64) (uint8, uint8, uint8) {
+	lr, lg, lb := labToLinear(l, a, b)
+	encode := func(c float64) uint8 {
+		return clampUint8(linearToSRGB(c) * 255)
+	}
+	return encode(lr), encode(lg), encode(lb)
+}
+
+// labToLinear converts a CIELAB color under a D65 white point to linear-light
+// RGB, which may fall outside [0, 1] for colors outside the sRGB gamut
+func labToLinear(l, a, b float64) (float64, float64, float64) {
+	fy := (l + 16) / 116
+	fx := fy + a/500
+	fz := fy - b/200
+
+	finv := func(t float64) float64 {
+		if t*t*t > 216.0/24389 {
+			return t * t * t
+		}
+		return (116*t - 16) * 27 / 24389
+	}
+	x, y, z := finv(fx)*whiteX, finv(fy)*whiteY, finv(fz)*whiteZ
+	return 3.2404542*x - 1.5371385*y - 0.4985314*z,
+		-0.9692660*x + 1.8760108*y + 0.0415560*z,
+		0.0556434*x - 0.2040259*y + 1.0572252*z
+}
+
+// buildLUT tabulates a curve over normalized [0, 1] channel values
+// The curve output is clamped to [0, 1] before scaling back to 8 bits
+func buildLUT(curve func(v float64) float64) *[256]uint8 {
+	var lut [256]uint8
+	for v := range lut {
+		norm := curve(float64(v) / 255.0)
+		lut[v] = uint8(math.Max(0, math.Min(1.0, norm)) * 255.0)
+	}
+	return &lut
+}
+
+// buildLUT16 tabulates a curve over every 16-bit channel value
+func buildLUT16(curve func(v float64) float64) []uint16 {
+	lut := make([]uint16, 1<<16)
+	for v := range lut {
+		norm := curve(float64(v) / 65535.0)
+		lut[v] = uint16(math.Max(0, math.Min(1.0, norm))*65535.0 + 0.5)
+	}
+	return lut
+}
+
+// autoContrast adjusts the contrast of img from its luma histogram
+// The tone curve is derived from luma and applied to every channel so hues are kept
+func autoContrast(img image.Image, options AutoContrastOptions) (image.Image, map[string]interface{}) {
+	gray := toGray(img)
+
+	switch options.Method {
+	case "equalize":
+		hist := lumaHistogram(gray, gray.Bounds())
+		return mapChannelsLUT(img, equalizeLUT(&hist)), nil
+	case "levels":
+		hist := lumaHistogram(gray, gray.Bounds())
+		low := histogramPercentile(&hist, *options.LowPercentile)
+		high := histogramPercentile(&hist, options.HighPercentile)
+		if high <= low {
+			return mapChannels(img, func(v float64) float64 { return v }), map[string]interface{}{"low": low, "high": high}
+		}
+		levels := func(v float64) float64 {
+			return (v*255 - float64(low)) / float64(high-low)
+		}
+		return mapChannels(img, levels), map[string]interface{}{"low": low, "high": high}
+	}
+	return clahe(img, gray, options.ClipLimit, options.TileSize), nil
+}
+
+// lumaHistogram counts the gray levels of the pixels of gray inside rect
+func lumaHistogram(gray *image.Gray, rect image.Rectangle) [256]int {
+	var hist [256]int
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := gray.Pix[gray.PixOffset(rect.Min.X, y):gray.PixOffset(rect.Max.X, y)]
+		for _, v := range row {
+			hist[v]++
+		}
+	}
+	return hist
+}
+
+// histogramPercentile returns the smallest level with at least percentile percent
+// of the pixels at or below it
+func histogramPercentile(hist *[256]int, percentile float64) int {
+	total := 0
+	for _, count := range hist {
+		total += count
+	}
+	target := float64(total) * percentile / 100
+	cumulative := 0
+	for level, count := range hist {
+		cumulative += count
+		if float64(cumulative) >= target && cumulative > 0 {
+			return level
+		}
+	}
+	return 255
+}
+
+// equalizeLUT builds the global histogram equalization curve
+// The first occupied level maps to black and the last to white
+func equalizeLUT(hist *[256]int) *[256]uint8 {
+	var lut [256]uint8
+	total, cdfMin := 0, 0
+	for _, count := range hist {
+		if cdfMin == 0 {
+			cdfMin = count
+		}
+		total += count
+	}
+	if total == cdfMin {
+		for v := range lut {
+			lut[v] = uint8(v)
+		}
+		return &lut
+	}
+
+	cumulative := 0
+	for v, count := range hist {
+		cumulative += count
+		if cumulative < cdfMin {
+			continue
+		}
+		lut[v] = clampUint8(float64(cumulative-cdfMin) / float64(total-cdfMin) * 255)
+	}
+	return &lut
+}
+
+// clipHistogram caps every bin at limit and spreads the excess evenly over all bins
+func clipHistogram(hist *[256]int, limit int) {
+	excess := 0
+	for v, count := range hist {
+		if count > limit {
+			excess += count - limit
+			hist[v] = limit
+		}
+	}
+	share, remainder := excess/256, excess%256
+	for v := range hist {
+		hist[v] += share
+		if v < remainder {
+			hist[v]++
+		}
+	}
+}
+
+// clahe applies contrast-limited adaptive histogram equalization
+// Each tile gets its own clipped equalization curve and every pixel blends the
+// curves of the four nearest tile centers bilinearly
+func clahe(img image.Image, gray *image.Gray, clipLimit float64, tileSize int) image.Image {
+	bounds := gray.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	// A tile larger than the image is the whole image
+	tileSize = max(1, min(tileSize, max(width, height)))
+	tilesX := (width + tileSize - 1) / tileSize
+	tilesY := (height + tileSize - 1) / tileSize
+
+	luts := make([]*[256]uint8, tilesX*tilesY)
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			rect := image.Rect(tx*tileSize, ty*tileSize, (tx+1)*tileSize, (ty+1)*tileSize).
+				Add(bounds.Min).Intersect(bounds)
+			hist := lumaHistogram(gray, rect)
+			pixels := rect.Dx() * rect.Dy()
+			clipHistogram(&hist, max(1, int(clipLimit*float64(pixels)/256)))
+
+			var lut [256]uint8
+			cumulative := 0
+			for v, count := range hist {
+				cumulative += count
+				lut[v] = clampUint8(float64(cumulative) / float64(pixels) * 255)
+			}
+			luts[ty*tilesX+tx] = &lut
+		}
+	}
+
+	// tileCoord locates a pixel between the two nearest tile centers along one axis
+	tileCoord := func(pos, tiles int) (int, int, float64) {
+		f := (float64(pos)+0.5)/float64(tileSize) - 0.5
+		t0 := int(math.Floor(f))
+		weight := f - float64(t0)
+		if t0 < 0 {
+			return 0, 0, 0
+		}
+		if t0 >= tiles-1 {
+			return tiles - 1, tiles - 1, 0
+		}
+		return t0, t0 + 1, weight
+	}
+
+	type axisCoord struct {
+		t0, t1 int
+		weight float64
+	}
+	columns := make([]axisCoord, width)
+	for x := range columns {
+		t0, t1, weight := tileCoord(x, tilesX)
+		columns[x] = axisCoord{t0, t1, weight}
+	}
+
+	// blend interpolates the four tile curves surrounding a pixel for one value
+	blend := func(row, col axisCoord, v uint8) uint8 {
+		top := (1-col.weight)*float64(luts[row.t0*tilesX+col.t0][v]) + col.weight*float64(luts[row.t0*tilesX+col.t1][v])
+		bottom := (1-col.weight)*float64(luts[row.t1*tilesX+col.t0][v]) + col.weight*float64(luts[row.t1*tilesX+col.t1][v])
+		return clampUint8((1-row.weight)*top + row.weight*bottom)
+	}
+
+	if _, ok := img.(*image.Gray); ok {
+		dst := image.NewGray(bounds)
+		parallelRows(height, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				t0, t1, weight := tileCoord(y, tilesY)
+				row := axisCoord{t0, t1, weight}
+				for x := 0; x < width; x++ {
+					dst.Pix[y*dst.Stride+x] = blend(row, columns[x], gray.Pix[y*gray.Stride+x])
+				}
+			}
+		})
+		return dst
+	}
+
+	result, dst := straightPixels(img)
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			t0, t1, weight := tileCoord(y, tilesY)
+			row := axisCoord{t0, t1, weight}
+			for x := 0; x < width; x++ {
+				i := y*dst.Stride + x*4
+				dst.Pix[i] = blend(row, columns[x], dst.Pix[i])
+				dst.Pix[i+1] = blend(row, columns[x], dst.Pix[i+1])
+				dst.Pix[i+2] = blend(row, columns[x], dst.Pix[i+2])
+			}
+		}
+	})
+	return result
+}
+
+// binaryPalette is the two color palette of binarized images, encoded as 1-bit PNGs
+var binaryPalette = color.Palette{color.Gray{Y: 0}, color.Gray{Y: 255}}
+
+// binarize converts img to black and white with a global Otsu threshold or a
+// local Sauvola or Niblack threshold computed over a sliding window
+func binarize(img image.Image, options BinarizeOptions) (*image.Paletted, map[string]interface{}) {
+	gray := toGray(img)
+	bounds := gray.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dst := image.NewPaletted(bounds, binaryPalette)
+
+	if options.Method == "otsu" {
+		hist := lumaHistogram(gray, bounds)
+		threshold := otsuThreshold(&hist)
+		parallelRows(height, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				for x := 0; x < width; x++ {
+					if gray.Pix[y*gray.Stride+x] > threshold {
+						dst.Pix[y*dst.Stride+x] = 1
+					}
+				}
+			}
+		})
+		return dst, map[string]interface{}{"threshold": threshold}
+	}
+
+	sums, squares := integralImages(gray)
+	radius := options.Window / 2
+	k := options.k()
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			top, bottom := max(y-radius, 0), min(y+radius+1, height)
+			for x := 0; x < width; x++ {
+				left, right := max(x-radius, 0), min(x+radius+1, width)
+				count := float64((bottom - top) * (right - left))
+				sum := integralSum(sums, width, left, top, right, bottom)
+				sumSquares := integralSum(squares, width, left, top, right, bottom)
+				mean := sum / count
+				stddev := math.Sqrt(math.Max(0, sumSquares/count-mean*mean))
+
+				var threshold float64
+				if options.Method == "sauvola" {
+					threshold = mean * (1 + k*(stddev/128-1))
+				} else {
+					threshold = mean + k*stddev
+				}
+				if float64(gray.Pix[y*gray.Stride+x]) > threshold {
+					dst.Pix[y*dst.Stride+x] = 1
+				}
+			}
+		}
+	})
+	return dst, nil
+}
+
+// otsuThreshold picks the gray level that maximizes the between-class variance
+// of the histogram
+func otsuThreshold(hist *[256]int) uint8 {
+	total, weightedTotal := 0, 0.0
+	for v, count := range hist {
+		total += count
+		weightedTotal += float64(v * count)
+	}
+
+	var best uint8
+	bestVariance, background, weightedBackground := -1.0, 0, 0.0
+	for v, count := range hist {
+		background += count
+		if background == 0 {
+			continue
+		}
+		foreground := total - background
+		if foreground == 0 {
+			break
+		}
+		weightedBackground += float64(v * count)
+		meanBackground := weightedBackground / float64(background)
+		meanForeground := (weightedTotal - weightedBackground) / float64(foreground)
+		variance := float64(background) * float64(foreground) * (meanBackground - meanForeground) * (meanBackground - meanForeground)
+		if variance > bestVariance {
+			bestVariance = variance
+			best = uint8(v)
+		}
+	}
+	return best
+}
+
+// integralImages builds summed-area tables of the gray levels and their squares
+// Both tables have one extra leading row and column of zeros
+func integralImages(gray *image.Gray) ([]float64, []float64) {
+	bounds := gray.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	stride := width + 1
+	sums := make([]float64, stride*(height+1))
+	squares := make([]float64, stride*(height+1))
+	for y := 0; y < height; y++ {
+		rowSum, rowSquares := 0.0, 0.0
+		for x := 0; x < width; x++ {
+			v := float64(gray.Pix[y*gray.Stride+x])
+			rowSum += v
+			rowSquares += v * v
+			sums[(y+1)*stride+x+1] = sums[y*stride+x+1] + rowSum
+			squares[(y+1)*stride+x+1] = squares[y*stride+x+1] + rowSquares
+		}
+	}
+	return sums, squares
+}
+
+// integralSum returns the sum over the rectangle [left, right) x [top, bottom)
+// of a summed-area table built for an image of the given width
+func integralSum(table []float64, width, left, top, right, bottom int) float64 {
+	stride := width + 1
+	return table[bottom*stride+right] - table[top*stride+right] - table[bottom*stride+left] + table[top*stride+left]
+}
+
+// flattenAnalysisSize is the longest edge images are scaled down to before the
+// illumination field is estimated
+const flattenAnalysisSize = 512
+
+// flattenIllumination evens out uneven lighting such as phone shadows
+// The illumination of each channel is estimated on a downscaled copy, either with
+// a large box blur or with a morphological closing that erases dark print before
+// smoothing, then scaled back up and divided out so the paper becomes uniformly white
+func flattenIllumination(img image.Image, options FlattenOptions) image.Image {
+	src := toRGBA(img)
+	bounds := src.Bounds()
+	small := toRGBA(scaleToFit(src, flattenAnalysisSize, flattenAnalysisSize, draw.ApproxBiLinear))
+	smallWidth, smallHeight := small.Bounds().Dx(), small.Bounds().Dy()
+	scale := float64(smallWidth) / float64(bounds.Dx())
+
+	radius := int(math.Round(float64(options.Radius) * scale))
+	if options.Radius == 0 {
+		radius = max(smallWidth, smallHeight) / 30
+	}
+	radius = max(radius, 1)
+
+	field := image.NewRGBA(small.Bounds())
+	draw.Draw(field, field.Bounds(), image.Opaque, image.Point{}, draw.Src)
+	plane := make([]float32, smallWidth*smallHeight)
+	for ch := 0; ch < 3; ch++ {
+		for y := 0; y < smallHeight; y++ {
+			for x := 0; x < smallWidth; x++ {
+				plane[y*smallWidth+x] = float32(small.Pix[y*small.Stride+x*4+ch])
+			}
+		}
+		if options.Method == "closing" {
+			extremumFilter(plane, smallWidth, smallHeight, radius, true)
+			extremumFilter(plane, smallWidth, smallHeight, radius, false)
+			boxBlur(plane, smallWidth, smallHeight, radius)
+		} else {
+			for pass := 0; pass < 3; pass++ {
+				boxBlur(plane, smallWidth, smallHeight, radius)
+			}
+		}
+		for y := 0; y < smallHeight; y++ {
+			for x := 0; x < smallWidth; x++ {
+				field.Pix[y*field.Stride+x*4+ch] = clampUint8(float64(plane[y*smallWidth+x]))
+			}
+		}
+	}
+
+	fullField := image.NewRGBA(bounds)
+	draw.BiLinear.Scale(fullField, bounds, field, field.Bounds(), draw.Src, nil)
+
+	rowBytes := bounds.Dx() * 4
+	parallelRows(bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := src.Pix[y*src.Stride : y*src.Stride+rowBytes]
+			lighting := fullField.Pix[y*fullField.Stride : y*fullField.Stride+rowBytes]
+			for i := 0; i+3 < len(row); i += 4 {
+				for ch := 0; ch < 3; ch++ {
+					row[i+ch] = clampUint8(float64(row[i+ch]) * 255 / math.Max(1, float64(lighting[i+ch])))
+				}
+			}
+		}
+	})
+
+	return keepGray(img, src)
+}
+
+// boxBlur replaces every value of a width x height plane with the mean of the
+// (2*radius+1) square around it, clamping the window at the edges
+func boxBlur(plane []float32, width, height, radius int) {
+	line := make([]float32, max(width, height))
+	blurLine := func(get func(i int) float32, set func(i int, v float32), n int) {
+		for i := 0; i < n; i++ {
+			line[i] = get(i)
+		}
+		sum := float32(0)
+		for i := -radius; i <= radius; i++ {
+			sum += line[min(max(i, 0), n-1)]
+		}
+		for i := 0; i < n; i++ {
+			set(i, sum/float32(2*radius+1))
+			sum += line[min(i+radius+1, n-1)] - line[max(i-radius, 0)]
+		}
+	}
+	for y := 0; y < height; y++ {
+		row := plane[y*width : (y+1)*width]
+		blurLine(func(i int) float32 { return row[i] }, func(i int, v float32) { row[i] = v }, width)
+	}
+	for x := 0; x < width; x++ {
+		blurLine(func(i int) float32 { return plane[i*width+x] }, func(i int, v float32) { plane[i*width+x] = v }, height)
+	}
+}
+
+// extremumFilter replaces every value of a width x height plane with the maximum
+// (dilation) or minimum (erosion) of the (2*radius+1) square around it
+func extremumFilter(plane []float32, width, height, radius int, maximum bool) {
+	pick := func(a, b float32) float32 {
+		if (b > a) == maximum {
+			return b
+		}
+		return a
+	}
+	line := make([]float32, max(width, height))
+	filterLine := func(get func(i int) float32, set func(i int, v float32), n int) {
+		for i := 0; i < n; i++ {
+			line[i] = get(i)
+		}
+		for i := 0; i < n; i++ {
+			v := line[i]
+			for j := max(i-radius, 0); j <= min(i+radius, n-1); j++ {
+				v = pick(v, line[j])
+			}
+			set(i, v)
+		}
+	}
+	for y := 0; y < height; y++ {
+		row := plane[y*width : (y+1)*width]
+		filterLine(func(i int) float32 { return row[i] }, func(i int, v float32) { row[i] = v }, width)
+	}
+	for x := 0; x < width; x++ {
+		filterLine(func(i int) float32 { return plane[i*width+x] }, func(i int, v float32) { plane[i*width+x] = v }, height)
+	}
+}
+
+// toRGBA copies img into a new RGBA image with the same bounds
+func toRGBA(img image.Image) *image.RGBA {
 	bounds := img.Bounds()
 	newImg := image.NewRGBA(bounds)
 	draw.Draw(newImg, bounds, img, bounds.Min, draw.Src)
+	return newImg
+}
+
+// applyLUT remaps the color channels of img in place through lut, leaving alpha untouched
+func applyLUT(img *image.RGBA, lut *[256]uint8) {
+	rowBytes := img.Bounds().Dx() * 4
+	parallelRows(img.Bounds().Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[y*img.Stride : y*img.Stride+rowBytes]
+			for i := 0; i+3 < len(row); i += 4 {
+				row[i] = lut[row[i]]
+				row[i+1] = lut[row[i+1]]
+				row[i+2] = lut[row[i+2]]
+			}
+		}
+	})
+}
+
+// applyLUT16 remaps the color channels of a 16-bit image in place through lut,
+// leaving alpha untouched
+func applyLUT16(img *image.NRGBA64, lut []uint16) {
+	rowBytes := img.Bounds().Dx() * 8
+	parallelRows(img.Bounds().Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[y*img.Stride : y*img.Stride+rowBytes]
+			for i := 0; i+7 < len(row); i += 8 {
+				for ch := i; ch < i+6; ch += 2 {
+					v := lut[uint16(row[ch])<<8|uint16(row[ch+1])]
+					row[ch], row[ch+1] = uint8(v>>8), uint8(v)
+				}
+			}
+		}
+	})
+}
+
+// applyGray16LUT remaps a 16-bit grayscale image in place through lut
+func applyGray16LUT(img *image.Gray16, lut []uint16) {
+	rowBytes := img.Bounds().Dx() * 2
+	parallelRows(img.Bounds().Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[y*img.Stride : y*img.Stride+rowBytes]
+			for i := 0; i+1 < len(row); i += 2 {
+				v := lut[uint16(row[i])<<8|uint16(row[i+1])]
+				row[i], row[i+1] = uint8(v>>8), uint8(v)
+			}
+		}
+	})
+}
+
+// applyGrayLUT remaps a grayscale image in place through lut
+func applyGrayLUT(img *image.Gray, lut *[256]uint8) {
+	width := img.Bounds().Dx()
+	parallelRows(img.Bounds().Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[y*img.Stride : y*img.Stride+width]
+			for i, v := range row {
+				row[i] = lut[v]
+			}
+		}
+	})
+}
+
+// mapChannels returns a copy of img with every color channel remapped through curve
+// 16-bit images keep their precision as Gray16 or NRGBA64, other images are
+// mapped through an 8-bit table as described for mapChannelsLUT
+func mapChannels(img image.Image, curve func(v float64) float64) image.Image {
+	if gray16, ok := img.(*image.Gray16); ok {
+		newImg := image.NewGray16(gray16.Bounds())
+		draw.Draw(newImg, gray16.Bounds(), gray16, gray16.Bounds().Min, draw.Src)
+		applyGray16LUT(newImg, buildLUT16(curve))
+		return newImg
+	}
+	if isHighBitDepth(img) {
+		newImg := toNRGBA64(img)
+		applyLUT16(newImg, buildLUT16(curve))
+		return newImg
+	}
+	return mapChannelsLUT(img, buildLUT(curve))
+}
+
+// mapChannelsLUT returns an 8-bit copy of img with every color channel remapped through lut
+// Grayscale images stay grayscale, images with transparency become NRGBA so the
+// table sees straight color values, everything else becomes RGBA
+func mapChannelsLUT(img image.Image, lut *[256]uint8) image.Image {
+	if _, ok := img.(*image.Gray); ok {
+		newImg := toGray(img)
+		applyGrayLUT(newImg, lut)
+		return newImg
+	}
+	newImg, pixels := straightPixels(img)
+	applyLUT(pixels, lut)
+	return newImg
+}
+
+// isHighBitDepth reports whether img stores more than 8 bits per channel
+func isHighBitDepth(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// isOpaque reports whether every pixel of img is fully opaque
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// straightPixels returns an 8-bit copy of img for per-channel edits together with
+// an RGBA view of its pixels. Opaque images are copied to RGBA. Images with
+// transparency are copied to NRGBA, so the view holds straight rather than
+// premultiplied color and tone curves do not darken semi-transparent edges
+func straightPixels(img image.Image) (image.Image, *image.RGBA) {
+	if isOpaque(img) {
+		newImg := toRGBA(img)
+		return newImg, newImg
+	}
+	newImg := toNRGBA(img)
+	return newImg, &image.RGBA{Pix: newImg.Pix, Stride: newImg.Stride, Rect: newImg.Rect}
+}
+
+// toNRGBA copies img into a new non-premultiplied 8-bit image with the same bounds
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	newImg := image.NewNRGBA(bounds)
+	if src, ok := img.(*image.NRGBA); ok {
+		rowBytes := bounds.Dx() * 4
+		for y := 0; y < bounds.Dy(); y++ {
+			copy(newImg.Pix[y*newImg.Stride:y*newImg.Stride+rowBytes], src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y+y):])
+		}
+		return newImg
+	}
+	draw.Draw(newImg, bounds, img, bounds.Min, draw.Src)
+	return newImg
+}
+
+// toNRGBA64 copies img into a new non-premultiplied 16-bit image with the same bounds
+func toNRGBA64(img image.Image) *image.NRGBA64 {
+	bounds := img.Bounds()
+	newImg := image.NewNRGBA64(bounds)
+	if src, ok := img.(*image.NRGBA64); ok {
+		rowBytes := bounds.Dx() * 8
+		for y := 0; y < bounds.Dy(); y++ {
+			copy(newImg.Pix[y*newImg.Stride:y*newImg.Stride+rowBytes], src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y+y):])
+		}
+		return newImg
+	}
+	draw.Draw(newImg, bounds, img, bounds.Min, draw.Src)
+	return newImg
+}
+
+// toGray converts img to a new 8-bit grayscale image using Rec. 601 luma weights
+func toGray(img image.Image) *image.Gray {
+	if gray, ok := img.(*image.Gray); ok {
+		newImg := image.NewGray(gray.Bounds())
+		draw.Draw(newImg, gray.Bounds(), gray, gray.Bounds().Min, draw.Src)
+		return newImg
+	}
+	src := toRGBA(img)
+	bounds := src.Bounds()
+	gray := image.NewGray(bounds)
+	width := bounds.Dx()
+	parallelRows(bounds.Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := src.Pix[y*src.Stride : y*src.Stride+width*4]
+			out := gray.Pix[y*gray.Stride : y*gray.Stride+width]
+			for x := range out {
+				r, g, b := int(row[x*4]), int(row[x*4+1]), int(row[x*4+2])
+				out[x] = uint8((299*r + 587*g + 114*b + 500) / 1000)
+			}
+		}
+	})
+	return gray
+}
+
+// sharpenImage sharpens img with a 3x3 Laplacian kernel scaled by amount
+// Channels are kept at or below alpha so translucent pixels stay valid
+// premultiplied colors
+func sharpenImage(img image.Image, amount float64) image.Image {
+	src := toRGBA(img)
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	width, height := bounds.Dx(), bounds.Dy()
 
-	contrastFactor := float64(contrast)
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			up, down := max(y-1, 0), min(y+1, height-1)
+			for x := 0; x < width; x++ {
+				left, right := max(x-1, 0), min(x+1, width-1)
+				i := y*src.Stride + x*4
+				for ch := 0; ch < 3; ch++ {
+					center := float64(src.Pix[i+ch])
+					neighbors := float64(src.Pix[up*src.Stride+x*4+ch]) +
+						float64(src.Pix[down*src.Stride+x*4+ch]) +
+						float64(src.Pix[y*src.Stride+left*4+ch]) +
+						float64(src.Pix[y*src.Stride+right*4+ch])
+					dst.Pix[i+ch] = min(clampUint8(center+amount*(4*center-neighbors)), src.Pix[i+3])
+				}
+				dst.Pix[i+3] = src.Pix[i+3]
+			}
+		}
+	})
+	return keepGray(img, dst)
+}
 
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := newImg.At(x, y).RGBA()
+// keepGray converts the result of a color filter back to grayscale when the
+// filter input was grayscale
+func keepGray(src image.Image, dst *image.RGBA) image.Image {
+	if _, ok := src.(*image.Gray); ok {
+		return toGray(dst)
+	}
+	return dst
+}
 
-			rNorm := (float64(r>>8)/255.0-0.5)*contrastFactor + 0.5
-			gNorm := (float64(g>>8)/255.0-0.5)*contrastFactor + 0.5
-			bNorm := (float64(b>>8)/255.0-0.5)*contrastFactor + 0.5
+// convolveImage applies a square convolution kernel to the color channels of img
+// The kernel has size x size weights in row-major order. Every weighted sum is
+// divided by divisor and shifted by offset, and edge pixels are repeated
+func convolveImage(img image.Image, kernel []float64, size int, divisor, offset float64) image.Image {
+	src := toRGBA(img)
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	width, height := bounds.Dx(), bounds.Dy()
+	radius := size / 2
 
-			rFinal := uint8(math.Max(0, math.Min(1.0, rNorm)) * 255.0)
-			gFinal := uint8(math.Max(0, math.Min(1.0, gNorm)) * 255.0)
-			bFinal := uint8(math.Max(0, math.Min(1.0, bNorm)) * 255.0)
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				var sums [3]float64
+				for ky := 0; ky < size; ky++ {
+					sy := min(max(y+ky-radius, 0), height-1)
+					for kx := 0; kx < size; kx++ {
+						sx := min(max(x+kx-radius, 0), width-1)
+						weight := kernel[ky*size+kx]
+						i := sy*src.Stride + sx*4
+						sums[0] += weight * float64(src.Pix[i])
+						sums[1] += weight * float64(src.Pix[i+1])
+						sums[2] += weight * float64(src.Pix[i+2])
+					}
+				}
+				i := y*dst.Stride + x*4
+				for ch := 0; ch < 3; ch++ {
+					dst.Pix[i+ch] = clampUint8(sums[ch]/divisor + offset)
+				}
+				dst.Pix[i+3] = src.Pix[i+3]
+			}
+		}
+	})
+	return keepGray(img, dst)
+}
+
+// gaussianBlur blurs the color channels of src with a separable Gaussian kernel
+// of standard deviation sigma
+func gaussianBlur(src *image.RGBA, sigma float64) *image.RGBA {
+	radius := max(1, int(math.Ceil(3*sigma)))
+	weights := make([]float64, 2*radius+1)
+	total := 0.0
+	for i := range weights {
+		d := float64(i - radius)
+		weights[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		total += weights[i]
+	}
+	for i := range weights {
+		weights[i] /= total
+	}
 
-			newImg.Set(x, y, color.RGBA{rFinal, gFinal, bFinal, uint8(a >> 8)})
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	// pass blurs along one axis, reading from in and writing to out
+	pass := func(in, out *image.RGBA, horizontal bool) {
+		parallelRows(height, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				for x := 0; x < width; x++ {
+					var sums [3]float64
+					for k, weight := range weights {
+						sx, sy := x, y
+						if horizontal {
+							sx = min(max(x+k-radius, 0), width-1)
+						} else {
+							sy = min(max(y+k-radius, 0), height-1)
+						}
+						i := sy*in.Stride + sx*4
+						sums[0] += weight * float64(in.Pix[i])
+						sums[1] += weight * float64(in.Pix[i+1])
+						sums[2] += weight * float64(in.Pix[i+2])
+					}
+					i := y*out.Stride + x*4
+					out.Pix[i], out.Pix[i+1], out.Pix[i+2] = clampUint8(sums[0]), clampUint8(sums[1]), clampUint8(sums[2])
+					out.Pix[i+3] = in.Pix[i+3]
+				}
+			}
+		})
+	}
+
+	horizontal := image.NewRGBA(bounds)
+	pass(src, horizontal, true)
+	dst := image.NewRGBA(bounds)
+	pass(horizontal, dst, false)
+	return dst
+}
+
+// unsharpMask sharpens img by adding back amount times the difference between the
+// image and a Gaussian blur of the given radius. Differences below threshold are
+// left alone so flat paper noise is not amplified
+func unsharpMask(img image.Image, radius, amount float64, threshold int) image.Image {
+	src := toRGBA(img)
+	blurred := gaussianBlur(src, radius)
+	rowBytes := src.Bounds().Dx() * 4
+
+	parallelRows(src.Bounds().Dy(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := src.Pix[y*src.Stride : y*src.Stride+rowBytes]
+			blurredRow := blurred.Pix[y*blurred.Stride : y*blurred.Stride+rowBytes]
+			for i := 0; i+3 < len(row); i += 4 {
+				for ch := i; ch < i+3; ch++ {
+					diff := int(row[ch]) - int(blurredRow[ch])
+					if diff >= threshold || -diff >= threshold {
+						row[ch] = clampUint8(float64(row[ch]) + amount*float64(diff))
+					}
+				}
+			}
 		}
+	})
+	return keepGray(img, src)
+}
+
+// medianFilter replaces every color channel value with the median of the
+// (2*radius+1) square around it, removing speckle noise while keeping edges
+func medianFilter(img image.Image, radius int) image.Image {
+	src := toRGBA(img)
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	width, height := bounds.Dx(), bounds.Dy()
+	windowSize := (2*radius + 1) * (2*radius + 1)
+
+	parallelRows(height, func(y0, y1 int) {
+		window := make([]uint8, windowSize)
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				i := y*dst.Stride + x*4
+				for ch := 0; ch < 3; ch++ {
+					n := 0
+					for dy := -radius; dy <= radius; dy++ {
+						sy := min(max(y+dy, 0), height-1)
+						for dx := -radius; dx <= radius; dx++ {
+							sx := min(max(x+dx, 0), width-1)
+							window[n] = src.Pix[sy*src.Stride+sx*4+ch]
+							n++
+						}
+					}
+					// Insertion sort is quick for windows of at most 49 values
+					for a := 1; a < n; a++ {
+						for b := a; b > 0 && window[b] < window[b-1]; b-- {
+							window[b], window[b-1] = window[b-1], window[b]
+						}
+					}
+					dst.Pix[i+ch] = window[n/2]
+				}
+				dst.Pix[i+3] = src.Pix[i+3]
+			}
+		}
+	})
+	return keepGray(img, dst)
+}
+
+// bilateralFilter smooths img while preserving edges: every neighbor within radius
+// is weighted by its distance (sigmaSpace) and by how close its color is to the
+// center pixel (sigmaColor)
+func bilateralFilter(img image.Image, radius int, sigmaColor, sigmaSpace float64) image.Image {
+	src := toRGBA(img)
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	width, height := bounds.Dx(), bounds.Dy()
+
+	size := 2*radius + 1
+	spatial := make([]float64, size*size)
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			spatial[(dy+radius)*size+dx+radius] = math.Exp(-float64(dx*dx+dy*dy) / (2 * sigmaSpace * sigmaSpace))
+		}
+	}
+	// Color weights are tabulated by the rounded RGB distance, at most 255*sqrt(3)
+	rangeWeights := make([]float64, 443)
+	for d := range rangeWeights {
+		rangeWeights[d] = math.Exp(-float64(d*d) / (2 * sigmaColor * sigmaColor))
+	}
+
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				i := y*src.Stride + x*4
+				r0, g0, b0 := float64(src.Pix[i]), float64(src.Pix[i+1]), float64(src.Pix[i+2])
+				var sums [3]float64
+				total := 0.0
+				for dy := -radius; dy <= radius; dy++ {
+					sy := min(max(y+dy, 0), height-1)
+					for dx := -radius; dx <= radius; dx++ {
+						sx := min(max(x+dx, 0), width-1)
+						j := sy*src.Stride + sx*4
+						r, g, b := float64(src.Pix[j]), float64(src.Pix[j+1]), float64(src.Pix[j+2])
+						distance := int(math.Sqrt((r-r0)*(r-r0)+(g-g0)*(g-g0)+(b-b0)*(b-b0)) + 0.5)
+						weight := spatial[(dy+radius)*size+dx+radius] * rangeWeights[distance]
+						sums[0] += weight * r
+						sums[1] += weight * g
+						sums[2] += weight * b
+						total += weight
+					}
+				}
+				dst.Pix[i] = clampUint8(sums[0] / total)
+				dst.Pix[i+1] = clampUint8(sums[1] / total)
+				dst.Pix[i+2] = clampUint8(sums[2] / total)
+				dst.Pix[i+3] = src.Pix[i+3]
+			}
+		}
+	})
+	return keepGray(img, dst)
+}
+
+// clampUint8 rounds v and clamps it to the 0-255 range
+func clampUint8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// minBandHeight is the smallest number of rows handed to a single worker
+const minBandHeight = 16
+
+// parallelRows splits the rows [0, height) into bands and runs fn over each band
+// on a pool of at most GOMAXPROCS workers
+func parallelRows(height int, fn func(y0, y1 int)) {
+	workers := runtime.GOMAXPROCS(0)
+	bandHeight := max(minBandHeight, (height+workers*4-1)/(workers*4))
+	if workers == 1 || height <= bandHeight {
+		fn(0, height)
+		return
 	}
-	return newImg, nil
+
+	bands := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for y0 := range bands {
+				fn(y0, min(y0+bandHeight, height))
+			}
+		}()
+	}
+	for y0 := 0; y0 < height; y0 += bandHeight {
+		bands <- y0
+	}
+	close(bands)
+	wg.Wait()
 }
 
-// processImage takes a base64 string and contrast factor, returns a new base64 string
-func processImage(base64Str string, contrast float64) (string, error) {
-	// Determine image type (e.g., "image/jpeg") from base64 string prefix
-	parts := strings.SplitN(base64Str, ",", 2)
+// decodeDataURI decodes the image bytes of a data URI (e.g. "data:image/jpeg;base64,...")
+func decodeDataURI(dataURI string) ([]byte, error) {
+	parts := strings.SplitN(dataURI, ",", 2)
 	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid base64 image format")
+		return nil, fmt.Errorf("invalid base64 image format")
 	}
-	mimeType, base64Data := parts[0], parts[1]
+	return base64.StdEncoding.DecodeString(parts[1])
+}
 
-	decodedData, err := base64.StdEncoding.DecodeString(base64Data)
+// dataURIHeader builds the data URI header for a mime type
+func dataURIHeader(mimeType string) string {
+	return "data:" + mimeType + ";base64"
+}
+
+// imageOutput describes how a processed image is encoded
+type imageOutput struct {
+	Format       string // "png" or "jpeg", empty keeps JPEG input as JPEG and writes everything else as PNG
+	Quality      int    // JPEG quality from 1 to 100, 0 uses the encoder default
+	KeepMetadata bool   // Copy the source EXIF block into JPEG output, all metadata is dropped otherwise
+}
+
+// newImageOutput validates the requested output settings
+func newImageOutput(options OutputOptions, keepMetadata bool) (imageOutput, error) {
+	format := strings.ToLower(options.OutputFormat)
+	switch format {
+	case "", "png", "jpeg":
+	case "jpg":
+		format = "jpeg"
+	default:
+		return imageOutput{}, fmt.Errorf("unsupported output_format: %s (use png or jpeg)", options.OutputFormat)
+	}
+	if options.JPEGQuality < 0 || options.JPEGQuality > 100 {
+		return imageOutput{}, fmt.Errorf("jpeg_quality must be between 1 and 100 (0 for the default), got: %d", options.JPEGQuality)
+	}
+	return imageOutput{Format: format, Quality: options.JPEGQuality, KeepMetadata: keepMetadata}, nil
+}
+
+// processedImage is the encoded result of running the pipeline over an image
+type processedImage struct {
+	Source   image.Image // The decoded input the pipeline ran over
+	Image    image.Image // The processed pixels before encoding
+	Data     []byte
+	MimeType string
+	Width    int
+	Height   int
+	Results  []OperationResult
+}
+
+// dataURI encodes the processed image as a base64 data URI
+func (p *processedImage) dataURI() string {
+	return dataURIHeader(p.MimeType) + "," + base64.StdEncoding.EncodeToString(p.Data)
+}
+
+// decodeImage decodes raw image bytes in any registered format, sniffed from the
+// data itself, and turns JPEGs upright according to their EXIF orientation
+// The size limits are checked before decoding. The format name and the EXIF block,
+// when present, are returned with the image
+func decodeImage(data []byte) (image.Image, string, *exifData, error) {
+	if err := checkImageSize(data); err != nil {
+		return nil, "", nil, err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return "", err
+		return nil, "", nil, &imageError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    errorCodeInvalidImage,
+			Message: fmt.Sprintf("unable to decode image: %v", err),
+		}
+	}
+
+	exif := readExif(data)
+	if exif != nil {
+		img = applyOrientation(img, exif.orientation)
 	}
+	return img, format, exif, nil
+}
 
-	img, _, err := image.Decode(bytes.NewReader(decodedData))
+// processImageBytes decodes raw image bytes, runs the pipeline steps over it and
+// encodes the result as described by output
+func processImageBytes(data []byte, output imageOutput, steps []pipelineStep) (*processedImage, error) {
+	img, sourceFormat, exif, err := decodeImage(data)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return processDecoded(img, sourceFormat, exif, output, steps)
+}
 
-	processedImg, err := changeContrast(img, contrast)
+// processDecoded runs the pipeline steps over a decoded image and encodes the
+// result as described by output
+func processDecoded(img image.Image, sourceFormat string, exif *exifData, output imageOutput, steps []pipelineStep) (*processedImage, error) {
+	processedImg, results, err := runPipeline(img, steps)
+	if err != nil {
+		return nil, err
+	}
+	processed, err := encodeProcessed(processedImg, sourceFormat, exif, output, results)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	processed.Source = img
+	return processed, nil
+}
+
+// encodeProcessed encodes a processed image as described by output
+// sourceFormat and exif describe the decoded input and pick the default format
+// and the metadata to keep
+func encodeProcessed(img image.Image, sourceFormat string, exif *exifData, output imageOutput, results []OperationResult) (*processedImage, error) {
+	format := output.Format
+	if format == "" {
+		format = "png"
+		if sourceFormat == "jpeg" {
+			format = "jpeg"
+		}
 	}
 
 	var buf bytes.Buffer
-	if strings.Contains(mimeType, "jpeg") {
-		err = jpeg.Encode(&buf, processedImg, nil)
-	} else if strings.Contains(mimeType, "png") {
-		err = png.Encode(&buf, processedImg)
-	} else {
-		return "", fmt.Errorf("unsupported image type: %s", mimeType)
+	if err := encodeImage(&buf, img, format, output.Quality); err != nil {
+		return nil, err
 	}
 
-	if err != nil {
-		return "", err
+	encoded := buf.Bytes()
+	// The encoders never write metadata, so the output only carries EXIF when the
+	// caller asks to keep it
+	if output.KeepMetadata && exif != nil && format == "jpeg" {
+		encoded = insertExif(encoded, exif.uprightPayload())
 	}
+	return &processedImage{
+		Image:    img,
+		Data:     encoded,
+		MimeType: "image/" + format,
+		Width:    img.Bounds().Dx(),
+		Height:   img.Bounds().Dy(),
+		Results:  results,
+	}, nil
+}
 
-	return mimeType + "," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+// encodeImage writes img to w in the given format
+func encodeImage(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case "jpeg":
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		return png.Encode(w, img)
+	}
+	return fmt.Errorf("unsupported image type: %s", format)
 }
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// changeContrastReference is the original per-pixel implementation of changeContrast
+// It is kept as the baseline for the equivalence test and the benchmarks
+func changeContrastReference(img image.Image, contrast float64) (*image.RGBA, error) {
+	bounds := img.Bounds()
+	newImg := image.NewRGBA(bounds)
+	draw.Draw(newImg, bounds, img, bounds.Min, draw.Src)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := newImg.At(x, y).RGBA()
+
+			rNorm := (float64(r>>8)/255.0-0.5)*contrast + 0.5
+			gNorm := (float64(g>>8)/255.0-0.5)*contrast + 0.5
+			bNorm := (float64(b>>8)/255.0-0.5)*contrast + 0.5
+
+			rFinal := uint8(math.Max(0, math.Min(1.0, rNorm)) * 255.0)
+			gFinal := uint8(math.Max(0, math.Min(1.0, gNorm)) * 255.0)
+			bFinal := uint8(math.Max(0, math.Min(1.0, bNorm)) * 255.0)
+
+			newImg.Set(x, y, color.RGBA{rFinal, gFinal, bFinal, uint8(a >> 8)})
+		}
+	}
+	return newImg, nil
+}
+
+// randomImage builds an opaque RGBA image filled with pseudo-random pixels
+func randomImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(1))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	return img
+}
+
+func TestChangeContrastMatchesReference(t *testing.T) {
+	img := randomImage(301, 257)
+	for _, contrast := range []float64{0, 0.5, 1, 1.5, 3} {
+		got, err := changeContrast(img, contrast)
+		if err != nil {
+			t.Fatalf("changeContrast(%v): %v", contrast, err)
+		}
+		want, _ := changeContrastReference(img, contrast)
+		gotRGBA, ok := got.(*image.RGBA)
+		if !ok {
+			t.Fatalf("contrast %v: got %T, want *image.RGBA", contrast, got)
+		}
+		for i := range want.Pix {
+			if gotRGBA.Pix[i] != want.Pix[i] {
+				t.Fatalf("contrast %v: byte %d = %d, want %d", contrast, i, gotRGBA.Pix[i], want.Pix[i])
+			}
+		}
+	}
+}
+
+func TestChangeContrastOffsetBounds(t *testing.T) {
+	img := randomImage(64, 48).SubImage(image.Rect(10, 7, 50, 40))
+	result, _ := changeContrast(img, 1.8)
+	want, _ := changeContrastReference(img, 1.8)
+	got := result.(*image.RGBA)
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("bounds = %v, want %v", got.Bounds(), want.Bounds())
+	}
+	for i := range want.Pix {
+		if got.Pix[i] != want.Pix[i] {
+			t.Fatalf("byte %d = %d, want %d", i, got.Pix[i], want.Pix[i])
+		}
+	}
+}
+
+func TestChangeContrastStraightAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:i+4], []uint8{200, 100, 40, 128})
+	}
+	result, _ := changeContrast(img, 1.5)
+	got, ok := result.(*image.NRGBA)
+	if !ok {
+		t.Fatalf("got %T, want *image.NRGBA", result)
+	}
+	want := color.NRGBA{
+		R: contrastValue(200, 1.5), G: contrastValue(100, 1.5), B: contrastValue(40, 1.5), A: 128,
+	}
+	if c := got.NRGBAAt(1, 1); c != want {
+		t.Fatalf("pixel = %v, want %v", c, want)
+	}
+}
+
+func TestChangeContrastKeeps16Bit(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 3, 2))
+	img.SetRGBA64(1, 1, color.RGBA64{R: 0x9000, G: 0x8001, B: 0x7fff, A: 0xffff})
+	result, _ := changeContrast(img, 2)
+	got, ok := result.(*image.NRGBA64)
+	if !ok {
+		t.Fatalf("got %T, want *image.NRGBA64", result)
+	}
+	want := color.NRGBA64{
+		R: contrastValue16(0x9000, 2), G: contrastValue16(0x8001, 2), B: contrastValue16(0x7fff, 2), A: 0xffff,
+	}
+	if c := got.NRGBA64At(1, 1); c != want {
+		t.Fatalf("pixel = %v, want %v", c, want)
+	}
+}
+
+// contrastValue applies the contrast curve to a single 8-bit value
+func contrastValue(v uint8, contrast float64) uint8 {
+	return uint8(math.Max(0, math.Min(1, (float64(v)/255-0.5)*contrast+0.5)) * 255)
+}
+
+// contrastValue16 applies the contrast curve to a single 16-bit value
+func contrastValue16(v uint16, contrast float64) uint16 {
+	return uint16(math.Max(0, math.Min(1, (float64(v)/65535-0.5)*contrast+0.5))*65535 + 0.5)
+}
+
+// benchmarkContrast runs fn over a 12MP image, the size of a typical phone photo
+func benchmarkContrast(b *testing.B, fn func(image.Image, float64) (image.Image, error)) {
+	img := randomImage(4000, 3000)
+	b.SetBytes(int64(len(img.Pix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fn(img, 1.5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChangeContrast(b *testing.B) {
+	benchmarkContrast(b, changeContrast)
+}
+
+func BenchmarkChangeContrastReference(b *testing.B) {
+	benchmarkContrast(b, func(img image.Image, contrast float64) (image.Image, error) {
+		return changeContrastReference(img, contrast)
+	})
+}
+
+func TestSharpenImageKeepsModel(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 4)
+	}
+	if got := sharpenImage(gray, 1); got.ColorModel() != color.GrayModel {
+		t.Errorf("gray input: got %T, want *image.Gray", got)
+	}
+
+	// A bright pixel next to a dark one overshoots, but must stay within its alpha
+	translucent := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	copy(translucent.Pix, []uint8{0, 0, 0, 128, 120, 120, 120, 128, 120, 120, 120, 128, 0, 0, 0, 128})
+	got := sharpenImage(translucent, 2).(*image.RGBA)
+	for i := 0; i < len(got.Pix); i += 4 {
+		for ch := 0; ch < 3; ch++ {
+			if got.Pix[i+ch] > got.Pix[i+3] {
+				t.Fatalf("pixel %d: channel %d = %d above alpha %d", i/4, ch, got.Pix[i+ch], got.Pix[i+3])
+			}
+		}
+	}
+}
+
+func TestLuminanceContrastKeepsColorModel(t *testing.T) {
+	deep := image.NewRGBA64(image.Rect(0, 0, 2, 1))
+	deep.SetRGBA64(0, 0, color.RGBA64{R: 0x9000, G: 0x9000, B: 0x9000, A: 0xffff})
+	deep.SetRGBA64(1, 0, color.RGBA64{R: 0x9001, G: 0x9001, B: 0x9001, A: 0xffff})
+
+	tests := []struct {
+		img  image.Image
+		want color.Model
+	}{
+		{image.NewGray(image.Rect(0, 0, 2, 2)), color.GrayModel},
+		{image.NewGray16(image.Rect(0, 0, 2, 2)), color.Gray16Model},
+		{deep, color.NRGBA64Model},
+		{image.NewNRGBA64(image.Rect(0, 0, 2, 2)), color.NRGBA64Model},
+		{randomImage(2, 2), color.RGBAModel},
+	}
+	for _, space := range []string{"ycbcr", "lab"} {
+		for _, tt := range tests {
+			if got := luminanceContrast(tt.img, 1.5, space); got.ColorModel() != tt.want {
+				t.Errorf("%s: %T input came back as %T", space, tt.img, got)
+			}
+		}
+	}
+
+	// Neutral 16-bit pixels follow the plain contrast curve without losing the low byte
+	got := luminanceContrast(deep, 2, "ycbcr").(*image.NRGBA64)
+	for x, v := range []uint16{0x9000, 0x9001} {
+		want := contrastValue16(v, 2)
+		if c := got.NRGBA64At(x, 0); c.R != want || c.G != want || c.B != want {
+			t.Errorf("pixel %d = %v, want gray %#x", x, c, want)
+		}
+	}
+}
+
+func TestEqualizeLUT(t *testing.T) {
+	var hist [256]int
+	hist[50], hist[100], hist[200] = 10, 10, 20
+	lut := equalizeLUT(&hist)
+	// The first occupied level goes to black, the rest follow the cumulative share
+	for v, want := range map[int]uint8{50: 0, 100: 85, 200: 255} {
+		if lut[v] != want {
+			t.Errorf("level %d maps to %d, want %d", v, lut[v], want)
+		}
+	}
+
+	// A single level has nothing to spread and is left alone
+	var flat [256]int
+	flat[120] = 64
+	if lut := equalizeLUT(&flat); lut[120] != 120 {
+		t.Errorf("single level 120 maps to %d, want 120", lut[120])
+	}
+}
+
+func TestAutoLevels(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 101, 1))
+	for x := range img.Pix {
+		img.Pix[x] = uint8(50 + x)
+	}
+	low := 0.0
+	result, details := autoContrast(img, AutoContrastOptions{Method: "levels", LowPercentile: &low, HighPercentile: 100})
+	if details["low"] != 50 || details["high"] != 150 {
+		t.Errorf("got levels %v to %v, want 50 to 150", details["low"], details["high"])
+	}
+	got := result.(*image.Gray)
+	for x, want := range map[int]uint8{0: 0, 50: 127, 100: 255} {
+		if got.Pix[x] != want {
+			t.Errorf("level %d maps to %d, want %d", img.Pix[x], got.Pix[x], want)
+		}
+	}
+}
+
+func TestCLAHEClipLimitOnUniformImage(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = 100
+	}
+	// Each 16x16 tile has its 256 pixels in one bin. A clip limit of 2 caps the bin
+	// at 2 and spreads the other 254 over the levels from 0, one each, so level
+	// 100 ends up with 100 + 3 of the 256 pixels at or below it
+	want := clampUint8(103.0 / 256 * 255)
+	got := clahe(img, img, 2, 16).(*image.Gray)
+	for i, v := range got.Pix {
+		if v != want {
+			t.Fatalf("pixel %d = %d, want %d", i, v, want)
+		}
+	}
+
+	// Plain equalization would send the whole image to white
+	if got := clahe(img, img, 256, 16).(*image.Gray); got.Pix[0] != 255 {
+		t.Errorf("without clipping: pixel = %d, want 255", got.Pix[0])
+	}
+}
+
+func TestOtsuThresholdBimodal(t *testing.T) {
+	// Two clusters of ink around 40 and paper around 200
+	var hist [256]int
+	for d := -5; d <= 5; d++ {
+		hist[40+d] = 30 - 5*abs(d)
+		hist[200+d] = 60 - 10*abs(d)
+	}
+	if got := otsuThreshold(&hist); got != 45 {
+		t.Errorf("threshold = %d, want 45, the top of the dark cluster", got)
+	}
+}
+
+func TestBinarizeSauvolaUnevenLighting(t *testing.T) {
+	// Paper brightening from 110 on the left to 240 on the right, with dark marks
+	// 80 levels below it. The marks on the right are brighter than the paper on the
+	// left, so no global threshold separates them
+	img := image.NewGray(image.Rect(0, 0, 131, 40))
+	isMark := func(x, y int) bool { return x%20 >= 8 && x%20 < 12 && y >= 16 && y < 24 }
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 131; x++ {
+			v := 110 + x
+			if isMark(x, y) {
+				v -= 80
+			}
+			img.Pix[y*img.Stride+x] = uint8(v)
+		}
+	}
+
+	k := 0.34
+	got, _ := binarize(img, BinarizeOptions{Method: "sauvola", Window: 15, K: &k})
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 131; x++ {
+			if want := !isMark(x, y); (got.Pix[y*got.Stride+x] == 1) != want {
+				t.Fatalf("pixel (%d, %d) white = %v, want %v", x, y, !want, want)
+			}
+		}
+	}
+}
+
+// abs returns the absolute value of v
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"image"
+	"math"
+	"math/cmplx"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// alignmentSize is the edge of the square, a power of two, the photos are scaled
+// into for phase correlation
+const alignmentSize = 512
+
+// minAlignmentConfidence is the lowest phase correlation peak accepted as a match
+// Photos below it most likely show a different scene and are left out of the fusion
+const minAlignmentConfidence = 0.03
+
+// alignedPhoto is a photo moved into the frame of the reference photo
+type alignedPhoto struct {
+	Image      *image.RGBA // Same size as the reference photo
+	Covered    []bool      // Pixels the photo has data for after the shift
+	DX, DY     float64     // Shift of the photo relative to the reference, in reference pixels
+	Confidence float64     // Height of the phase correlation peak, from 0 to 1
+}
+
+// alignPhotos registers every photo against the first one with phase correlation
+// and shifts it into the frame of the first photo. The photos are scaled to the
+// size of the first one, only translation between them is corrected
+func alignPhotos(images []image.Image) []alignedPhoto {
+	bounds := images[0].Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	scale := float64(alignmentSize) / float64(max(width, height))
+
+	photos := make([]alignedPhoto, len(images))
+	var reference []complex128
+	for k, img := range images {
+		rgba := toRGBA(resizeImage(img, width, height, draw.BiLinear))
+		small := toGray(scaleToFit(rgba, alignmentSize, alignmentSize, draw.ApproxBiLinear))
+		spectrum := alignmentSpectrum(small)
+
+		if k == 0 {
+			reference = spectrum
+			covered := make([]bool, width*height)
+			for i := range covered {
+				covered[i] = true
+			}
+			photos[0] = alignedPhoto{Image: rgba, Covered: covered, Confidence: 1}
+			continue
+		}
+
+		dx, dy, peak := phaseCorrelate(reference, spectrum)
+		dx, dy = dx/math.Min(scale, 1), dy/math.Min(scale, 1)
+		shifted, covered := shiftImage(rgba, dx, dy)
+		photos[k] = alignedPhoto{
+			Image:      shifted,
+			Covered:    covered,
+			DX:         math.Round(dx*10) / 10,
+			DY:         math.Round(dy*10) / 10,
+			Confidence: math.Round(peak*1000) / 1000,
+		}
+	}
+	return photos
+}
+
+// alignmentSpectrum returns the 2D Fourier transform of gray placed in an
+// alignmentSize square, with the mean removed and a Hann window applied so the
+// image edges do not dominate the correlation
+func alignmentSpectrum(gray *image.Gray) []complex128 {
+	bounds := gray.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	mean := 0.0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mean += float64(gray.Pix[y*gray.Stride+x])
+		}
+	}
+	mean /= float64(width * height)
+
+	data := make([]complex128, alignmentSize*alignmentSize)
+	for y := 0; y < height; y++ {
+		wy := 0.5 - 0.5*math.Cos(2*math.Pi*float64(y)/float64(max(height-1, 1)))
+		for x := 0; x < width; x++ {
+			wx := 0.5 - 0.5*math.Cos(2*math.Pi*float64(x)/float64(max(width-1, 1)))
+			data[y*alignmentSize+x] = complex((float64(gray.Pix[y*gray.Stride+x])-mean)*wx*wy, 0)
+		}
+	}
+	fft2D(data, alignmentSize, false)
+	return data
+}
+
+// phaseCorrelate finds the translation of the image with spectrum moved relative
+// to the image with spectrum reference, in analysis pixels, and the height of the
+// correlation peak as a confidence from 0 to 1
+func phaseCorrelate(reference, moved []complex128) (float64, float64, float64) {
+	n := alignmentSize
+	cross := make([]complex128, len(reference))
+	for i := range cross {
+		c := moved[i] * cmplx.Conj(reference[i])
+		if magnitude := cmplx.Abs(c); magnitude > 1e-12 {
+			cross[i] = c / complex(magnitude, 0)
+		}
+	}
+	fft2D(cross, n, true)
+
+	best, peak := 0, math.Inf(-1)
+	for i, v := range cross {
+		if real(v) > peak {
+			best, peak = i, real(v)
+		}
+	}
+	px, py := best%n, best/n
+
+	// refine estimates the sub-pixel offset of the peak along one axis from the
+	// ratio of the peak to its larger neighbor (Foroosh et al.)
+	refine := func(left, center, right float64) float64 {
+		if right >= left && right > 0 {
+			return right / (right + center)
+		}
+		if left > 0 {
+			return -left / (left + center)
+		}
+		return 0
+	}
+	at := func(x, y int) float64 {
+		return real(cross[((y+n)%n)*n+(x+n)%n])
+	}
+	dx := float64(px) + refine(at(px-1, py), peak, at(px+1, py))
+	dy := float64(py) + refine(at(px, py-1), peak, at(px, py+1))
+
+	// Peaks past the middle wrap around to negative shifts
+	if dx > float64(n)/2 {
+		dx -= float64(n)
+	}
+	if dy > float64(n)/2 {
+		dy -= float64(n)
+	}
+	return dx, dy, math.Max(0, peak)
+}
+
+// fft2D transforms an n x n grid of complex values in place, row by row and then
+// column by column. The inverse transform is scaled by 1/(n*n)
+func fft2D(data []complex128, n int, inverse bool) {
+	parallelRows(n, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			fft(data[y*n:(y+1)*n], inverse)
+		}
+	})
+	parallelRows(n, func(x0, x1 int) {
+		column := make([]complex128, n)
+		for x := x0; x < x1; x++ {
+			for y := 0; y < n; y++ {
+				column[y] = data[y*n+x]
+			}
+			fft(column, inverse)
+			for y := 0; y < n; y++ {
+				data[y*n+x] = column[y]
+			}
+		}
+	})
+	if inverse {
+		scale := complex(1/float64(n*n), 0)
+		for i := range data {
+			data[i] *= scale
+		}
+	}
+}
+
+// fft runs an in-place radix-2 Cooley-Tukey transform over data, whose length
+// must be a power of two
+func fft(data []complex128, inverse bool) {
+	n := len(data)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			data[i], data[j] = data[j], data[i]
+		}
+	}
+
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for length := 2; length <= n; length <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(length))
+		for start := 0; start < n; start += length {
+			w := complex(1, 0)
+			for k := 0; k < length/2; k++ {
+				even, odd := data[start+k], data[start+k+length/2]*w
+				data[start+k] = even + odd
+				data[start+k+length/2] = even - odd
+				w *= step
+			}
+		}
+	}
+}
+
+// shiftImage moves img back by dx, dy so that content found at (x+dx, y+dy) lands
+// on (x, y). Pixels the shifted image has no data for are marked as not covered
+func shiftImage(img *image.RGBA, dx, dy float64) (*image.RGBA, []bool) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	covered := make([]bool, width*height)
+
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			sy := float64(y) + dy
+			for x := 0; x < width; x++ {
+				sx := float64(x) + dx
+				if sx < 0 || sy < 0 || sx > float64(width-1) || sy > float64(height-1) {
+					continue
+				}
+				covered[y*width+x] = true
+				c := bilinearSample(img, sx+float64(bounds.Min.X), sy+float64(bounds.Min.Y))
+				p := y*dst.Stride + x*4
+				dst.Pix[p], dst.Pix[p+1], dst.Pix[p+2], dst.Pix[p+3] = c.R, c.G, c.B, c.A
+			}
+		}
+	})
+	return dst, covered
+}
+
+// sharpnessRadius is the radius of the window the local sharpness of a photo is
+// measured over
+const sharpnessRadius = 3
+
+// fusePhotos blends aligned photos of the same ticket into one image
+// "sharpness" weights every photo by its local Laplacian energy, so the sharpest
+// photo wins where the others are blurred. "median" takes the per-channel median,
+// which drops shadows and reflections found in a minority of the photos
+func fusePhotos(photos []alignedPhoto, method string) *image.RGBA {
+	bounds := photos[0].Image.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	fused := image.NewRGBA(bounds)
+
+	var weights [][]float32
+	if method == "sharpness" {
+		weights = make([][]float32, len(photos))
+		for k, photo := range photos {
+			weights[k] = localSharpness(toGray(photo.Image))
+		}
+	}
+
+	parallelRows(height, func(y0, y1 int) {
+		values := make([]uint8, 0, len(photos))
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				i := y*width + x
+				p := y*fused.Stride + x*4
+				fused.Pix[p+3] = 255
+
+				if method == "sharpness" {
+					var sums [3]float64
+					total := 0.0
+					for k, photo := range photos {
+						if !photo.Covered[i] {
+							continue
+						}
+						w := float64(weights[k][i]) + 1
+						for ch := 0; ch < 3; ch++ {
+							sums[ch] += w * float64(photo.Image.Pix[p+ch])
+						}
+						total += w
+					}
+					for ch := 0; ch < 3; ch++ {
+						fused.Pix[p+ch] = clampUint8(sums[ch] / total)
+					}
+					continue
+				}
+
+				for ch := 0; ch < 3; ch++ {
+					values = values[:0]
+					for _, photo := range photos {
+						if photo.Covered[i] {
+							values = append(values, photo.Image.Pix[p+ch])
+						}
+					}
+					sort.Slice(values, func(a, b int) bool { return values[a] < values[b] })
+					middle := len(values) / 2
+					if len(values)%2 == 0 {
+						fused.Pix[p+ch] = uint8((int(values[middle-1]) + int(values[middle]) + 1) / 2)
+					} else {
+						fused.Pix[p+ch] = values[middle]
+					}
+				}
+			}
+		}
+	})
+	return fused
+}
+
+// localSharpness returns the mean squared 4-neighbor Laplacian of gray over a
+// small window around every pixel
+func localSharpness(gray *image.Gray) []float32 {
+	bounds := gray.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	energy := make([]float32, width*height)
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*gray.Stride + x
+			v := float32(int(gray.Pix[i-gray.Stride]) + int(gray.Pix[i+gray.Stride]) + int(gray.Pix[i-1]) + int(gray.Pix[i+1]) - 4*int(gray.Pix[i]))
+			energy[y*width+x] = v * v
+		}
+	}
+	boxBlur(energy, width, height, sharpnessRadius)
+	return energy
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// translated returns a copy of img moved right by dx and down by dy pixels,
+// with the uncovered area left black
+func translated(img *image.RGBA, dx, dy int) *image.RGBA {
+	bounds := img.Bounds()
+	moved := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if src := (image.Point{X: x - dx, Y: y - dy}); src.In(bounds) {
+				moved.SetRGBA(x, y, img.RGBAAt(src.X, src.Y))
+			}
+		}
+	}
+	return moved
+}
+
+func TestAlignPhotosRecoversShift(t *testing.T) {
+	reference := randomImage(200, 160)
+	for _, shift := range []image.Point{{7, -4}, {-12, 9}, {0, 0}} {
+		photos := alignPhotos([]image.Image{reference, translated(reference, shift.X, shift.Y)})
+		got := photos[1]
+		if math.Abs(got.DX-float64(shift.X)) > 0.5 || math.Abs(got.DY-float64(shift.Y)) > 0.5 {
+			t.Errorf("moved by %v: found a shift of (%v, %v)", shift, got.DX, got.DY)
+		}
+		if got.Confidence < 0.5 {
+			t.Errorf("moved by %v: confidence %v, want a clear peak", shift, got.Confidence)
+		}
+
+		// Shifting back lines the photo up with the reference where it has data
+		for y := 20; y < 140; y += 17 {
+			for x := 20; x < 180; x += 13 {
+				if got.Covered[y*200+x] && got.Image.RGBAAt(x, y) != reference.RGBAAt(x, y) {
+					t.Fatalf("moved by %v: pixel (%d, %d) = %v after alignment, want %v", shift, x, y, got.Image.RGBAAt(x, y), reference.RGBAAt(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestFFTRoundTrip(t *testing.T) {
+	// The transform of a single impulse is flat, and the inverse brings it back
+	n := 8
+	data := make([]complex128, n*n)
+	data[3*n+5] = 1
+	fft2D(data, n, false)
+	for i, v := range data {
+		if math.Abs(real(v)*real(v)+imag(v)*imag(v)-1) > 1e-9 {
+			t.Fatalf("coefficient %d has magnitude %v, want 1", i, v)
+		}
+	}
+	fft2D(data, n, true)
+	for i, v := range data {
+		want := 0.0
+		if i == 3*n+5 {
+			want = 1
+		}
+		if math.Abs(real(v)-want) > 1e-9 || math.Abs(imag(v)) > 1e-9 {
+			t.Fatalf("value %d = %v after the round trip, want %v", i, v, want)
+		}
+	}
+}
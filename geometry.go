@@ -0,0 +1,552 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// deskewAnalysisSize is the longest edge images are scaled down to before the
+// skew angle is estimated
+const deskewAnalysisSize = 1000
+
+// estimateSkew finds the dominant text-line angle of img in degrees within
+// [-maxAngle, maxAngle], positive when lines run downhill to the right
+// Ink pixels from a local threshold are projected onto the vertical axis at each
+// candidate angle and the angle with the sharpest projection profile wins
+func estimateSkew(img image.Image, maxAngle float64) float64 {
+	small := scaleToFit(img, deskewAnalysisSize, deskewAnalysisSize, draw.ApproxBiLinear)
+	binarized, _ := binarize(small, BinarizeOptions{Method: "sauvola", Window: 15})
+	ink := inkPoints(binarized)
+	if len(ink) == 0 {
+		return 0
+	}
+
+	best := 0.0
+	bestScore := projectionScore(ink, 0)
+	search := func(from, to, step float64) {
+		for angle := from; angle <= to+step/2; angle += step {
+			if score := projectionScore(ink, angle); score > bestScore {
+				best, bestScore = angle, score
+			}
+		}
+	}
+	search(-maxAngle, maxAngle, 0.5)
+	search(best-0.5, best+0.5, 0.05)
+	return math.Round(best*100) / 100
+}
+
+// inkPoints lists the coordinates of the black pixels of a binarized image
+func inkPoints(img *image.Paletted) []image.Point {
+	bounds := img.Bounds()
+	var points []image.Point
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if img.Pix[y*img.Stride+x] == 0 {
+				points = append(points, image.Point{X: x, Y: y})
+			}
+		}
+	}
+	return points
+}
+
+// projectionScore projects points onto the axis perpendicular to lines at angle
+// degrees and returns the sum of squared bin counts, which peaks when the
+// points line up with the bins
+func projectionScore(points []image.Point, angle float64) float64 {
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	// Points come from an image of at most deskewAnalysisSize pixels a side, so
+	// every projection falls within this offset of zero
+	offset := 2 * deskewAnalysisSize
+	bins := make([]int, 2*offset+1)
+	for _, p := range points {
+		bins[offset+int(math.Round(float64(p.Y)*cos-float64(p.X)*sin))]++
+	}
+	score := 0.0
+	for _, count := range bins {
+		score += float64(count) * float64(count)
+	}
+	return score
+}
+
+// rotateImage rotates img counterclockwise by angle degrees around its center
+// The canvas grows to fit the rotated image and uncovered areas are filled white
+func rotateImage(img image.Image, angle float64) image.Image {
+	bounds := img.Bounds()
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	newWidth := int(math.Ceil(math.Abs(width*cos) + math.Abs(height*sin)))
+	newHeight := int(math.Ceil(math.Abs(width*sin) + math.Abs(height*cos)))
+
+	var dst draw.Image
+	if _, ok := img.(*image.Gray); ok {
+		dst = image.NewGray(image.Rect(0, 0, newWidth, newHeight))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	}
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	// Map source pixels to destination pixels: translate the source center to the
+	// origin, rotate, then translate to the destination center
+	srcX := float64(bounds.Min.X) + width/2
+	srcY := float64(bounds.Min.Y) + height/2
+	dstX, dstY := float64(newWidth)/2, float64(newHeight)/2
+	transform := f64.Aff3{
+		cos, sin, dstX - cos*srcX - sin*srcY,
+		-sin, cos, dstY + sin*srcX - cos*srcY,
+	}
+	draw.BiLinear.Transform(dst, transform, img, bounds, draw.Over, nil)
+	return dst
+}
+
+// deskewImage straightens img so the detected text lines are horizontal
+// It returns the detected skew angle in degrees
+func deskewImage(img image.Image, maxAngle float64) (image.Image, float64) {
+	angle := estimateSkew(img, maxAngle)
+	if math.Abs(angle) < 0.05 {
+		return img, angle
+	}
+	return rotateImage(img, angle), angle
+}
+
+// scaleToFit scales img down so it fits within maxWidth x maxHeight, keeping the
+// aspect ratio. Images that already fit are returned unchanged
+func scaleToFit(img image.Image, maxWidth, maxHeight int, scaler draw.Scaler) image.Image {
+	bounds := img.Bounds()
+	scale := math.Min(float64(maxWidth)/float64(bounds.Dx()), float64(maxHeight)/float64(bounds.Dy()))
+	if scale >= 1 {
+		return img
+	}
+	width := max(1, int(math.Round(float64(bounds.Dx())*scale)))
+	height := max(1, int(math.Round(float64(bounds.Dy())*scale)))
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	scaler.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// ticketAnalysisSize is the longest edge images are scaled down to before the
+// ticket boundary is searched for
+const ticketAnalysisSize = 800
+
+// pointF is a point with sub-pixel coordinates
+type pointF struct {
+	X, Y float64
+}
+
+// maxBackgroundDistance caps the color distance under which a pixel is still
+// treated as part of the background around the ticket
+const maxBackgroundDistance = 60
+
+// detectTicketQuad finds the corners of the ticket in img, ordered top-left,
+// top-right, bottom-right, bottom-left in source pixel coordinates
+// The background is flooded in from the image border over pixels close to the
+// median border color, and the largest remaining region is taken as the ticket.
+// Rough corners come from the extreme points of its edge, then a line is fitted to
+// the edge pixels of each side and the corners are moved to where neighboring
+// lines intersect
+func detectTicketQuad(img image.Image) ([4]pointF, bool) {
+	bounds := img.Bounds()
+	small := toRGBA(scaleToFit(img, ticketAnalysisSize, ticketAnalysisSize, draw.ApproxBiLinear))
+	width, height := small.Bounds().Dx(), small.Bounds().Dy()
+	scale := float64(bounds.Dx()) / float64(width)
+
+	background := borderColor(small)
+	distances := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*small.Stride + x*4
+			dr := float64(small.Pix[i]) - float64(background.R)
+			dg := float64(small.Pix[i+1]) - float64(background.G)
+			db := float64(small.Pix[i+2]) - float64(background.B)
+			distances.Pix[y*distances.Stride+x] = clampUint8(math.Sqrt(dr*dr+dg*dg+db*db) / math.Sqrt(3))
+		}
+	}
+	hist := lumaHistogram(distances, distances.Bounds())
+	threshold := min(otsuThreshold(&hist), maxBackgroundDistance)
+
+	// Flood the background from every border pixel close to the border color
+	isBackground := make([]bool, width*height)
+	var queue []int
+	push := func(x, y int) {
+		i := y*width + x
+		if !isBackground[i] && distances.Pix[y*distances.Stride+x] <= threshold {
+			isBackground[i] = true
+			queue = append(queue, i)
+		}
+	}
+	for x := 0; x < width; x++ {
+		push(x, 0)
+		push(x, height-1)
+	}
+	for y := 0; y < height; y++ {
+		push(0, y)
+		push(width-1, y)
+	}
+	for len(queue) > 0 {
+		i := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		x, y := i%width, i/width
+		if x > 0 {
+			push(x-1, y)
+		}
+		if x < width-1 {
+			push(x+1, y)
+		}
+		if y > 0 {
+			push(x, y-1)
+		}
+		if y < height-1 {
+			push(x, y+1)
+		}
+	}
+
+	mask := make([]bool, width*height)
+	for i, set := range isBackground {
+		mask[i] = !set
+	}
+	region, area := largestComponent(mask, width, height)
+	if area < width*height/10 {
+		return [4]pointF{}, false
+	}
+
+	// Edge pixels of the region are the ones with a 4-neighbor outside it
+	var edge []pointF
+	onBorder := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			if !region[i] {
+				continue
+			}
+			if x == 0 || y == 0 || x == width-1 || y == height-1 {
+				edge = append(edge, pointF{float64(x), float64(y)})
+				onBorder++
+			} else if !region[i-1] || !region[i+1] || !region[i-width] || !region[i+width] {
+				edge = append(edge, pointF{float64(x), float64(y)})
+			}
+		}
+	}
+	// A region that is mostly bounded by the image border is not a ticket lying
+	// on a background, it usually means the ticket fills the frame
+	if onBorder*2 > len(edge) {
+		return [4]pointF{}, false
+	}
+
+	corners := extremeCorners(edge)
+	corners = refineCorners(corners, edge, width, height)
+
+	for i := range corners {
+		corners[i] = pointF{
+			X: float64(bounds.Min.X) + (corners[i].X+0.5)*scale,
+			Y: float64(bounds.Min.Y) + (corners[i].Y+0.5)*scale,
+		}
+	}
+	return corners, true
+}
+
+// borderColor returns the per-channel median color of the outermost pixels of img
+func borderColor(img *image.RGBA) color.RGBA {
+	bounds := img.Bounds()
+	var hists [3][256]int
+	count := 0
+	add := func(x, y int) {
+		i := img.PixOffset(x, y)
+		for ch := 0; ch < 3; ch++ {
+			hists[ch][img.Pix[i+ch]]++
+		}
+		count++
+	}
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		add(x, bounds.Min.Y)
+		add(x, bounds.Max.Y-1)
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		add(bounds.Min.X, y)
+		add(bounds.Max.X-1, y)
+	}
+
+	var median [3]uint8
+	for ch := range hists {
+		median[ch] = uint8(histogramPercentile(&hists[ch], 50))
+	}
+	return color.RGBA{median[0], median[1], median[2], 255}
+}
+
+// largestComponent labels the 4-connected regions of mask and returns the largest
+// one along with its pixel count
+func largestComponent(mask []bool, width, height int) ([]bool, int) {
+	labels := make([]int, len(mask))
+	bestLabel, bestArea := 0, 0
+	queue := make([]int, 0, 1024)
+	label := 0
+	for start, set := range mask {
+		if !set || labels[start] != 0 {
+			continue
+		}
+		label++
+		labels[start] = label
+		queue = append(queue[:0], start)
+		area := 0
+		for len(queue) > 0 {
+			i := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			area++
+			x, y := i%width, i/width
+			for _, n := range [4]int{i - 1, i + 1, i - width, i + width} {
+				if (n == i-1 && x == 0) || (n == i+1 && x == width-1) || (n == i-width && y == 0) || (n == i+width && y == height-1) {
+					continue
+				}
+				if mask[n] && labels[n] == 0 {
+					labels[n] = label
+					queue = append(queue, n)
+				}
+			}
+		}
+		if area > bestArea {
+			bestLabel, bestArea = label, area
+		}
+	}
+
+	region := make([]bool, len(mask))
+	for i, l := range labels {
+		region[i] = l == bestLabel && bestLabel != 0
+	}
+	return region, bestArea
+}
+
+// extremeCorners picks the points furthest toward each corner of the image
+func extremeCorners(points []pointF) [4]pointF {
+	corners := [4]pointF{points[0], points[0], points[0], points[0]}
+	for _, p := range points {
+		if p.X+p.Y < corners[0].X+corners[0].Y {
+			corners[0] = p
+		}
+		if p.X-p.Y > corners[1].X-corners[1].Y {
+			corners[1] = p
+		}
+		if p.X+p.Y > corners[2].X+corners[2].Y {
+			corners[2] = p
+		}
+		if p.X-p.Y < corners[3].X-corners[3].Y {
+			corners[3] = p
+		}
+	}
+	return corners
+}
+
+// cornerMargin is how far outside the image, relative to its longest edge, a
+// refined corner may lie. Sides that are nearly parallel meet further out
+const cornerMargin = 0.05
+
+// refineCorners fits a line through the edge points along each side of the rough
+// quadrilateral and returns the intersections of neighboring sides
+// Corners whose sides have too few points to fit, or that meet further than
+// cornerMargin outside the width x height image, keep their rough position
+func refineCorners(corners [4]pointF, edge []pointF, width, height int) [4]pointF {
+	type line struct {
+		origin, direction pointF
+		ok                bool
+	}
+	var sides [4]line
+	for i := range sides {
+		a, b := corners[i], corners[(i+1)%4]
+		dx, dy := b.X-a.X, b.Y-a.Y
+		length := math.Hypot(dx, dy)
+		if length < 1 {
+			continue
+		}
+		tolerance := math.Max(3, 0.03*length)
+
+		var points []pointF
+		for _, p := range edge {
+			t := ((p.X-a.X)*dx + (p.Y-a.Y)*dy) / (length * length)
+			distance := math.Abs((p.X-a.X)*dy-(p.Y-a.Y)*dx) / length
+			if t > 0.1 && t < 0.9 && distance < tolerance {
+				points = append(points, p)
+			}
+		}
+		if len(points) < 10 {
+			continue
+		}
+		origin, direction := fitLine(points)
+		sides[i] = line{origin, direction, true}
+	}
+
+	margin := cornerMargin * float64(max(width, height))
+	inside := func(p pointF) bool {
+		return p.X >= -margin && p.Y >= -margin && p.X <= float64(width)+margin && p.Y <= float64(height)+margin
+	}
+	refined := corners
+	for i := range refined {
+		previous, next := sides[(i+3)%4], sides[i]
+		if !previous.ok || !next.ok {
+			continue
+		}
+		if p, ok := intersectLines(previous.origin, previous.direction, next.origin, next.direction); ok && inside(p) {
+			refined[i] = p
+		}
+	}
+	return refined
+}
+
+// fitLine returns the centroid and principal direction of points, the total
+// least squares line through them
+func fitLine(points []pointF) (pointF, pointF) {
+	var mean pointF
+	for _, p := range points {
+		mean.X += p.X
+		mean.Y += p.Y
+	}
+	mean.X /= float64(len(points))
+	mean.Y /= float64(len(points))
+
+	var sxx, sxy, syy float64
+	for _, p := range points {
+		dx, dy := p.X-mean.X, p.Y-mean.Y
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	angle := 0.5 * math.Atan2(2*sxy, sxx-syy)
+	return mean, pointF{math.Cos(angle), math.Sin(angle)}
+}
+
+// intersectLines intersects two lines given as a point and a direction
+func intersectLines(p1, d1, p2, d2 pointF) (pointF, bool) {
+	det := d1.X*d2.Y - d1.Y*d2.X
+	if math.Abs(det) < 1e-9 {
+		return pointF{}, false
+	}
+	t := ((p2.X-p1.X)*d2.Y - (p2.Y-p1.Y)*d2.X) / det
+	return pointF{p1.X + t*d1.X, p1.Y + t*d1.Y}, true
+}
+
+// homography solves for the projective transform that maps each from point onto
+// the matching to point. The result holds the first 8 entries of the 3x3 matrix,
+// the last entry is 1
+func homography(from, to [4]pointF) ([8]float64, bool) {
+	var system [8][9]float64
+	for i := 0; i < 4; i++ {
+		x, y, u, v := from[i].X, from[i].Y, to[i].X, to[i].Y
+		system[2*i] = [9]float64{x, y, 1, 0, 0, 0, -u * x, -u * y, u}
+		system[2*i+1] = [9]float64{0, 0, 0, x, y, 1, -v * x, -v * y, v}
+	}
+
+	// Gaussian elimination with partial pivoting
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(system[row][col]) > math.Abs(system[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(system[pivot][col]) < 1e-12 {
+			return [8]float64{}, false
+		}
+		system[col], system[pivot] = system[pivot], system[col]
+		for row := 0; row < 8; row++ {
+			if row == col {
+				continue
+			}
+			factor := system[row][col] / system[col][col]
+			for k := col; k < 9; k++ {
+				system[row][k] -= factor * system[col][k]
+			}
+		}
+	}
+
+	var h [8]float64
+	for i := range h {
+		h[i] = system[i][8] / system[i][i]
+	}
+	return h, true
+}
+
+// warpPerspective maps the quadrilateral corners of img onto a flat
+// width x height rectangle, sampling the source bilinearly
+func warpPerspective(img image.Image, corners [4]pointF, width, height int) (*image.RGBA, bool) {
+	target := [4]pointF{{0, 0}, {float64(width), 0}, {float64(width), float64(height)}, {0, float64(height)}}
+	h, ok := homography(target, corners)
+	if !ok {
+		return nil, false
+	}
+
+	src := toRGBA(img)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				fx, fy := float64(x)+0.5, float64(y)+0.5
+				w := h[6]*fx + h[7]*fy + 1
+				u := (h[0]*fx + h[1]*fy + h[2]) / w
+				v := (h[3]*fx + h[4]*fy + h[5]) / w
+				c := bilinearSample(src, u-0.5, v-0.5)
+				dst.SetRGBA(x, y, c)
+			}
+		}
+	})
+	return dst, true
+}
+
+// bilinearSample interpolates the color of img at a sub-pixel position given in
+// image coordinates, clamping to the nearest edge pixel outside the bounds
+func bilinearSample(img *image.RGBA, x, y float64) color.RGBA {
+	bounds := img.Bounds()
+	x = math.Max(float64(bounds.Min.X), math.Min(float64(bounds.Max.X-1), x))
+	y = math.Max(float64(bounds.Min.Y), math.Min(float64(bounds.Max.Y-1), y))
+	x0, y0 := int(x), int(y)
+	x1, y1 := min(x0+1, bounds.Max.X-1), min(y0+1, bounds.Max.Y-1)
+	wx, wy := x-float64(x0), y-float64(y0)
+
+	var out [4]uint8
+	for ch := 0; ch < 4; ch++ {
+		top := (1-wx)*float64(img.Pix[img.PixOffset(x0, y0)+ch]) + wx*float64(img.Pix[img.PixOffset(x1, y0)+ch])
+		bottom := (1-wx)*float64(img.Pix[img.PixOffset(x0, y1)+ch]) + wx*float64(img.Pix[img.PixOffset(x1, y1)+ch])
+		out[ch] = clampUint8((1-wy)*top + wy*bottom)
+	}
+	return color.RGBA{out[0], out[1], out[2], out[3]}
+}
+
+// cropTicket detects the ticket in img and warps it to a flat rectangle with the
+// background cropped away. Images without a detectable ticket, or whose flattened
+// ticket would exceed the pixel limit, are returned unchanged
+func cropTicket(img image.Image) (image.Image, [4]pointF, bool) {
+	corners, ok := detectTicketQuad(img)
+	if !ok {
+		return img, corners, false
+	}
+
+	distance := func(a, b pointF) float64 { return math.Hypot(b.X-a.X, b.Y-a.Y) }
+	width := int(math.Round(math.Max(distance(corners[0], corners[1]), distance(corners[3], corners[2]))))
+	height := int(math.Round(math.Max(distance(corners[0], corners[3]), distance(corners[1], corners[2]))))
+	if width < 1 || height < 1 || int64(width) > limits.MaxPixels/int64(height) {
+		return img, corners, false
+	}
+
+	warped, ok := warpPerspective(img, corners, width, height)
+	if !ok {
+		return img, corners, false
+	}
+	return warped, corners, true
+}
+
+// resizeImage scales img to exactly width x height with the given interpolator
+// Grayscale images stay grayscale, everything else becomes RGBA
+func resizeImage(img image.Image, width, height int, scaler draw.Scaler) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return img
+	}
+
+	var dst draw.Image
+	if _, ok := img.(*image.Gray); ok {
+		dst = image.NewGray(image.Rect(0, 0, width, height))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	scaler.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+// textImage draws rows of dark word-sized blocks on a white page
+func textImage(width, height int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	for y := 40; y+12 < height-40; y += 30 {
+		for x := 40; x+30 < width-40; x += 45 {
+			draw.Draw(img, image.Rect(x, y, x+30, y+12), image.NewUniform(color.Black), image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
+
+func TestDeskewRecoversRotation(t *testing.T) {
+	page := textImage(500, 400)
+	for _, angle := range []float64{-4, 2.5} {
+		// Rotating clockwise makes the lines run downhill, a positive skew
+		straightened, skew := deskewImage(rotateImage(page, -angle), 10)
+		if math.Abs(skew-angle) > 0.2 {
+			t.Errorf("rotated by %v: estimated skew %v", angle, skew)
+		}
+		if residual := estimateSkew(straightened, 10); math.Abs(residual) > 0.2 {
+			t.Errorf("rotated by %v: %v of skew left after deskewing", angle, residual)
+		}
+	}
+
+	if _, skew := deskewImage(page, 10); skew != 0 {
+		t.Errorf("straight page: estimated skew %v, want 0", skew)
+	}
+}
+
+func TestHomographyMapsCorners(t *testing.T) {
+	from := [4]pointF{{0, 0}, {100, 0}, {100, 50}, {0, 50}}
+	to := [4]pointF{{12, 8}, {130, 20}, {118, 95}, {5, 70}}
+	h, ok := homography(from, to)
+	if !ok {
+		t.Fatal("no homography found")
+	}
+	for i, p := range from {
+		w := h[6]*p.X + h[7]*p.Y + 1
+		u := (h[0]*p.X + h[1]*p.Y + h[2]) / w
+		v := (h[3]*p.X + h[4]*p.Y + h[5]) / w
+		if math.Abs(u-to[i].X) > 1e-6 || math.Abs(v-to[i].Y) > 1e-6 {
+			t.Errorf("corner %d: mapped to (%v, %v), want %v", i, u, v, to[i])
+		}
+	}
+
+	// Three corners on one line leave the transform undetermined
+	if _, ok := homography([4]pointF{{0, 0}, {50, 0}, {100, 0}, {0, 50}}, to); ok {
+		t.Error("expected no homography for collinear corners")
+	}
+}
+
+func TestRefineCornersStaysNearImage(t *testing.T) {
+	// The top side runs along y = 0 and the left side, drawn from a rough corner
+	// far to the left, almost parallel to it. Their lines meet at x = 500
+	corners := [4]pointF{{0, 0}, {100, 0}, {100, 100}, {-100, 1}}
+	var edge []pointF
+	for x := 10.0; x <= 90; x += 5 {
+		edge = append(edge, pointF{x, 0})
+	}
+	for x := -90.0; x <= -10; x += 5 {
+		edge = append(edge, pointF{x, 0.5 - 0.001*x})
+	}
+
+	if got := refineCorners(corners, edge, 100, 100); got[0] != corners[0] {
+		t.Errorf("got corner %v far outside a 100x100 image, want the rough %v", got[0], corners[0])
+	}
+	if got := refineCorners(corners, edge, 1000, 1000); math.Abs(got[0].X-500) > 1e-6 || math.Abs(got[0].Y) > 1e-6 {
+		t.Errorf("got corner %v inside a 1000x1000 image, want (500, 0)", got[0])
+	}
+}
+
+// ticketPhoto draws a light ticket on a dark background
+func ticketPhoto() (*image.RGBA, image.Rectangle) {
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{40, 45, 50, 255}), image.Point{}, draw.Src)
+	ticket := image.Rect(80, 60, 240, 180)
+	draw.Draw(img, ticket, image.NewUniform(color.RGBA{245, 240, 230, 255}), image.Point{}, draw.Src)
+	return img, ticket
+}
+
+func TestCropTicket(t *testing.T) {
+	photo, ticket := ticketPhoto()
+	cropped, corners, found := cropTicket(photo)
+	if !found {
+		t.Fatal("no ticket found")
+	}
+	want := [4]image.Point{ticket.Min, {ticket.Max.X, ticket.Min.Y}, ticket.Max, {ticket.Min.X, ticket.Max.Y}}
+	for i, corner := range corners {
+		if math.Abs(corner.X-float64(want[i].X)) > 3 || math.Abs(corner.Y-float64(want[i].Y)) > 3 {
+			t.Errorf("corner %d at %v, want near %v", i, corner, want[i])
+		}
+	}
+	bounds := cropped.Bounds()
+	if math.Abs(float64(bounds.Dx()-ticket.Dx())) > 4 || math.Abs(float64(bounds.Dy()-ticket.Dy())) > 4 {
+		t.Errorf("cropped to %v, want about %v", bounds.Size(), ticket.Size())
+	}
+	if r, _, _, _ := cropped.At(bounds.Dx()/2, bounds.Dy()/2).RGBA(); r>>8 != 245 {
+		t.Errorf("center of the crop has red %d, want the ticket's 245", r>>8)
+	}
+
+	// A flattened ticket larger than the pixel limit is not produced
+	original := limits
+	defer func() { limits = original }()
+	limits.MaxPixels = int64(ticket.Dx() * ticket.Dy() / 2)
+	if img, _, found := cropTicket(photo); found || img != image.Image(photo) {
+		t.Error("expected the image back unchanged over the pixel limit")
+	}
+
+	// A blank photo has no ticket
+	blank := image.NewRGBA(image.Rect(0, 0, 100, 80))
+	if img, _, found := cropTicket(blank); found || img != image.Image(blank) {
+		t.Error("expected the blank image back unchanged")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// glareMinRadius is the radius of the smallest bright patch treated as glare
+const glareMinRadius = 2
+
+// glareMask marks the pixels of img that look like specular glare: brighter than
+// the threshold and nearly colorless, which sets reflections apart from the red,
+// blue and gold print. The mask is grown by the dilate radius to cover the bright
+// halo around each patch
+func glareMask(img *image.RGBA, options GlareOptions) []bool {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	plane := make([]float32, width*height)
+
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[y*img.Stride : y*img.Stride+width*4]
+			for x := 0; x < width; x++ {
+				r, g, b := int(row[x*4]), int(row[x*4+1]), int(row[x*4+2])
+				luma := (299*r + 587*g + 114*b + 500) / 1000
+				high, low := max(r, g, b), min(r, g, b)
+				if luma >= options.Threshold && high > 0 && float64(high-low)/float64(high) <= *options.MaxSaturation {
+					plane[y*width+x] = 1
+				}
+			}
+		}
+	})
+	// An opening drops thin bright specks such as sharpening halos along the print,
+	// then the patches that are left are grown past their original size
+	extremumFilter(plane, width, height, glareMinRadius, false)
+	extremumFilter(plane, width, height, glareMinRadius+*options.Dilate, true)
+
+	mask := make([]bool, len(plane))
+	for i, v := range plane {
+		mask[i] = v > 0
+	}
+	return mask
+}
+
+// maskPercent returns the share of marked pixels in mask as a percentage
+func maskPercent(mask []bool) float64 {
+	if len(mask) == 0 {
+		return 0
+	}
+	marked := 0
+	for _, m := range mask {
+		if m {
+			marked++
+		}
+	}
+	return math.Round(10000*float64(marked)/float64(len(mask))) / 100
+}
+
+// suppressGlare detects the glare in img and replaces it with color filled in from
+// the surrounding paper ("inpaint"), or pulls it towards that color while keeping
+// any print still visible underneath ("attenuate")
+func suppressGlare(img image.Image, options GlareOptions) (image.Image, map[string]interface{}) {
+	rgba := toRGBA(img)
+	mask := glareMask(rgba, options)
+	removeMasked(rgba, mask, options)
+	return keepGray(img, rgba), map[string]interface{}{"glare_percent": maskPercent(mask)}
+}
+
+// glareFillRadius is the starting radius of the blur that spreads the paper color
+// into glare regions, doubled for pixels it does not reach
+const glareFillRadius = 8
+
+// removeMasked replaces the masked pixels of img in place as selected by
+// options.Method. "inpaint" fills them with the color of the surrounding paper.
+// "attenuate" subtracts the smooth glare brightness down to that color, which
+// keeps any print still visible underneath
+func removeMasked(img *image.RGBA, mask []bool, options GlareOptions) {
+	width := img.Bounds().Dx()
+	paper := smoothFill(img, paperWeights(img, mask), glareFillRadius)
+
+	var glare [3][]float32
+	if options.Method == "attenuate" {
+		weights := make([]float32, len(mask))
+		for i, masked := range mask {
+			if masked {
+				weights[i] = 1
+			}
+		}
+		glare = smoothFill(img, weights, glareFillRadius)
+	}
+
+	for i, masked := range mask {
+		if !masked {
+			continue
+		}
+		p := (i/width)*img.Stride + (i%width)*4
+		for ch := 0; ch < 3; ch++ {
+			if options.Method == "attenuate" {
+				excess := glare[ch][i] - paper[ch][i]
+				img.Pix[p+ch] = clampUint8(float64(img.Pix[p+ch]) - *options.Strength*float64(excess))
+			} else {
+				img.Pix[p+ch] = clampUint8(float64(paper[ch][i]))
+			}
+		}
+	}
+}
+
+// paperWeights selects the pixels outside mask that show bare paper, leaving out
+// the print with an Otsu threshold on their luma so it does not darken the fill
+func paperWeights(img *image.RGBA, mask []bool) []float32 {
+	width := img.Bounds().Dx()
+	var hist [256]int
+	for i, masked := range mask {
+		if !masked {
+			hist[pixelLuma(img, i%width, i/width)/1000]++
+		}
+	}
+	threshold := int(otsuThreshold(&hist))
+
+	weights := make([]float32, len(mask))
+	found := false
+	for i, masked := range mask {
+		if !masked && pixelLuma(img, i%width, i/width)/1000 > threshold {
+			weights[i] = 1
+			found = true
+		}
+	}
+	if !found {
+		// No separable print, use every pixel outside the mask
+		for i, masked := range mask {
+			if !masked {
+				weights[i] = 1
+			}
+		}
+	}
+	return weights
+}
+
+// smoothFill spreads the color of the pixels with a nonzero weight over the whole
+// image with a normalized box blur, returning one plane per color channel
+// Pixels out of reach of every weighted pixel are filled by blurring again with
+// a doubled radius, at least once however small the image. Pixels stay 0 when no
+// pixel has a weight
+func smoothFill(img *image.RGBA, weights []float32, radius int) [3][]float32 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	var fill [3][]float32
+	for ch := range fill {
+		fill[ch] = make([]float32, width*height)
+	}
+
+	filled := make([]bool, width*height)
+	remaining := len(filled)
+	for first := true; remaining > 0 && (first || radius < 2*max(width, height)); first, radius = false, radius*2 {
+		weightSum := make([]float32, len(weights))
+		copy(weightSum, weights)
+		boxBlur(weightSum, width, height, radius)
+
+		var planes [3][]float32
+		for ch := range planes {
+			planes[ch] = make([]float32, len(weights))
+			for i, w := range weights {
+				if w != 0 {
+					planes[ch][i] = w * float32(img.Pix[(i/width)*img.Stride+(i%width)*4+ch])
+				}
+			}
+			boxBlur(planes[ch], width, height, radius)
+		}
+
+		for i, w := range weightSum {
+			if filled[i] || w < 1e-4 {
+				continue
+			}
+			for ch := range fill {
+				fill[ch][i] = planes[ch][i] / w
+			}
+			filled[i] = true
+			remaining--
+		}
+	}
+	return fill
+}
+
+// fuseGlare combines photos of the same ticket into one image without glare
+// The photos are aligned to the first one, and photos that cannot be aligned are
+// left out. Every pixel is averaged over the photos that show no glare there, and
+// pixels with glare in every photo are filled as by suppressGlare. The glare found
+// in each photo and the share left for filling are returned
+func fuseGlare(images []image.Image, options GlareOptions) (image.Image, []float64, float64) {
+	aligned := alignPhotos(images)
+	bounds := aligned[0].Image.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var photos []*image.RGBA
+	var masks [][]bool
+	percents := make([]float64, len(aligned))
+	for k, photo := range aligned {
+		mask := glareMask(photo.Image, options)
+		percents[k] = maskPercent(mask)
+		if photo.Confidence < minAlignmentConfidence {
+			continue
+		}
+		// Pixels the shifted photo does not cover count as glare
+		for i, covered := range photo.Covered {
+			mask[i] = mask[i] || !covered
+		}
+		photos = append(photos, photo.Image)
+		masks = append(masks, mask)
+	}
+
+	fused := image.NewRGBA(image.Rect(0, 0, width, height))
+	remaining := make([]bool, width*height)
+	parallelRows(height, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < width; x++ {
+				i := y*width + x
+				var sums [3]int
+				count := 0
+				for k, photo := range photos {
+					if masks[k][i] {
+						continue
+					}
+					p := y*photo.Stride + x*4
+					sums[0] += int(photo.Pix[p])
+					sums[1] += int(photo.Pix[p+1])
+					sums[2] += int(photo.Pix[p+2])
+					count++
+				}
+				p := y*fused.Stride + x*4
+				fused.Pix[p+3] = 255
+				if count > 0 {
+					for ch := 0; ch < 3; ch++ {
+						fused.Pix[p+ch] = uint8((sums[ch] + count/2) / count)
+					}
+					continue
+				}
+
+				// Every photo has glare here, start from the least blown-out one
+				remaining[i] = true
+				darkest := 0
+				for k := 1; k < len(photos); k++ {
+					if pixelLuma(photos[k], x, y) < pixelLuma(photos[darkest], x, y) {
+						darkest = k
+					}
+				}
+				q := y*photos[darkest].Stride + x*4
+				copy(fused.Pix[p:p+3], photos[darkest].Pix[q:q+3])
+			}
+		}
+	})
+
+	removeMasked(fused, remaining, options)
+	return fused, percents, maskPercent(remaining)
+}
+
+// pixelLuma returns the Rec. 601 luma of the pixel at x, y relative to the image origin
+func pixelLuma(img *image.RGBA, x, y int) int {
+	p := y*img.Stride + x*4
+	return 299*int(img.Pix[p]) + 587*int(img.Pix[p+1]) + 114*int(img.Pix[p+2])
+}
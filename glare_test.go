@@ -0,0 +1,24 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestSmoothFillTinyImage(t *testing.T) {
+	// Images smaller than the fill radius still get one pass
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:i+4], []uint8{200, 150, 100, 255})
+	}
+	weights := make([]float32, 6)
+	weights[0] = 1
+	fill := smoothFill(img, weights, glareFillRadius)
+	for ch, want := range []float32{200, 150, 100} {
+		for i, v := range fill[ch] {
+			if v < want-0.5 || v > want+0.5 {
+				t.Errorf("channel %d, pixel %d = %v, want %v", ch, i, v, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/inconsolata"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Size glyphs are scaled to before they are compared with the templates
+const (
+	glyphGridWidth  = 12
+	glyphGridHeight = 16
+)
+
+// glyphCharset lists the characters the templates are rendered for
+const glyphCharset = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ/)"
+
+// aspectPenalty weighs how much a differing width to height ratio lowers the
+// match score, which keeps narrow glyphs such as 1 and I apart from wide ones
+const aspectPenalty = 0.25
+
+// Glyphs shorter than this share of the line height are punctuation
+const punctuationHeight = 0.45
+
+// glyphTemplate is a character rendered in one of the monospaced template fonts
+type glyphTemplate struct {
+	Char     rune
+	Aspect   float64   // Width to height ratio of the ink
+	Features []float32 // See glyphFeatures
+}
+
+// glyphMatch is the character a glyph was recognized as
+type glyphMatch struct {
+	Char   rune
+	Score  float64 // Correlation with the best template, up to 1
+	Margin float64 // Lead of the score over the best template of another character
+}
+
+// glyphTemplates renders the template fonts once, on first use
+var glyphTemplates = sync.OnceValue(buildGlyphTemplates)
+
+// buildGlyphTemplates renders every character of glyphCharset in the bitmap
+// fonts shipped with golang.org/x/image and in Go Mono, which between them cover
+// the thin and bold monospaced faces of lottery terminals
+func buildGlyphTemplates() []glyphTemplate {
+	faces := []font.Face{basicfont.Face7x13, inconsolata.Regular8x16, inconsolata.Bold8x16}
+	for _, ttf := range [][]byte{gomono.TTF, gomonobold.TTF} {
+		parsed, err := opentype.Parse(ttf)
+		if err != nil {
+			panic(err)
+		}
+		face, err := opentype.NewFace(parsed, &opentype.FaceOptions{Size: 48, DPI: 72, Hinting: font.HintingNone})
+		if err != nil {
+			panic(err)
+		}
+		faces = append(faces, face)
+	}
+
+	var templates []glyphTemplate
+	for _, face := range faces {
+		for _, char := range glyphCharset {
+			canvas := image.NewGray(image.Rect(0, 0, 96, 96))
+			draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+			drawer := font.Drawer{Dst: canvas, Src: image.Black, Face: face, Dot: fixed.P(16, 72)}
+			drawer.DrawString(string(char))
+
+			box := image.Rectangle{}
+			for y := 0; y < 96; y++ {
+				for x := 0; x < 96; x++ {
+					if canvas.Pix[y*canvas.Stride+x] < 128 {
+						box = box.Union(image.Rect(x, y, x+1, y+1))
+					}
+				}
+			}
+			templates = append(templates, glyphTemplate{
+				Char:     char,
+				Aspect:   float64(box.Dx()) / float64(box.Dy()),
+				Features: glyphFeatures(canvas, box),
+			})
+		}
+	}
+	return templates
+}
+
+// glyphFeatures scales the glyph in box of img, dark ink on a light background,
+// to the glyph grid and returns its ink coverage with the mean removed and
+// normalized to unit length, so the dot product of two features is their
+// correlation
+func glyphFeatures(img image.Image, box image.Rectangle) []float32 {
+	grid := image.NewGray(image.Rect(0, 0, glyphGridWidth, glyphGridHeight))
+	draw.BiLinear.Scale(grid, grid.Bounds(), img, box, draw.Src, nil)
+
+	features := make([]float32, len(grid.Pix))
+	mean := float32(0)
+	for i, v := range grid.Pix {
+		features[i] = 1 - float32(v)/255
+		mean += features[i]
+	}
+	mean /= float32(len(features))
+	norm := float32(0)
+	for i := range features {
+		features[i] -= mean
+		norm += features[i] * features[i]
+	}
+	if norm > 0 {
+		norm = float32(math.Sqrt(float64(norm)))
+		for i := range features {
+			features[i] /= norm
+		}
+	}
+	return features
+}
+
+// recognizeGlyph matches the glyph in box of img against the templates of the
+// characters in charset
+func recognizeGlyph(img image.Image, box image.Rectangle, charset string) glyphMatch {
+	features := glyphFeatures(img, box)
+	aspect := float64(box.Dx()) / float64(box.Dy())
+
+	scores := make(map[rune]float64)
+	for _, template := range glyphTemplates() {
+		if !strings.ContainsRune(charset, template.Char) {
+			continue
+		}
+		score := 0.0
+		for i, v := range features {
+			score += float64(v * template.Features[i])
+		}
+		score -= aspectPenalty * math.Abs(math.Log(aspect/template.Aspect))
+		if current, ok := scores[template.Char]; !ok || score > current {
+			scores[template.Char] = score
+		}
+	}
+
+	ranked := make([]glyphMatch, 0, len(scores))
+	for char, score := range scores {
+		ranked = append(ranked, glyphMatch{Char: char, Score: score})
+	}
+	if len(ranked) == 0 {
+		return glyphMatch{Char: '?'}
+	}
+	sort.Slice(ranked, func(a, b int) bool { return ranked[a].Score > ranked[b].Score })
+	best := ranked[0]
+	if len(ranked) > 1 {
+		best.Margin = best.Score - ranked[1].Score
+	}
+	return best
+}
+
+// readWord recognizes the glyphs of a word of line in the binarized image
+// Glyphs much shorter than the line are read from their position as '.' or '-'
+// instead of being matched against the templates
+func readWord(binary *image.Paletted, line textLine, word textWord, charset string) []glyphMatch {
+	matches := make([]glyphMatch, len(word.Glyphs))
+	for i, box := range word.Glyphs {
+		if float64(box.Dy()) < punctuationHeight*float64(line.Height) {
+			char := '.'
+			if box.Max.Y < line.Box.Max.Y-line.Height/4 {
+				char = '-'
+			}
+			matches[i] = glyphMatch{Char: char, Score: 1, Margin: 1}
+			continue
+		}
+		matches[i] = recognizeGlyph(binary, box.Add(binary.Bounds().Min), charset)
+	}
+	return matches
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// imageLimits bounds the size of the images the service is willing to process
+// and how much batch work it takes on per request
+type imageLimits struct {
+	MaxBodyBytes    int64 // Largest request body accepted by the image routes
+	MaxEncodedBytes int64 // Largest encoded image, after base64 decoding
+	MaxPixels       int64 // Largest decoded image, in width x height pixels
+	MaxBatchItems   int64 // Most images accepted in one batch request
+	BatchWorkers    int64 // Images of a batch processed at the same time
+}
+
+// maxTicketPhotos is the most photos of a single ticket combined in one request
+const maxTicketPhotos = 5
+
+// limits holds the active image limits, read from the environment at startup
+var limits = loadImageLimits()
+
+// loadImageLimits reads the image limits from IMAGE_MAX_BODY_BYTES,
+// IMAGE_MAX_ENCODED_BYTES, IMAGE_MAX_PIXELS, IMAGE_MAX_BATCH_ITEMS and
+// IMAGE_BATCH_WORKERS, falling back to the defaults
+func loadImageLimits() imageLimits {
+	return imageLimits{
+		MaxBodyBytes:    envInt64("IMAGE_MAX_BODY_BYTES", 32<<20),
+		MaxEncodedBytes: envInt64("IMAGE_MAX_ENCODED_BYTES", 20<<20),
+		MaxPixels:       envInt64("IMAGE_MAX_PIXELS", 50_000_000),
+		MaxBatchItems:   envInt64("IMAGE_MAX_BATCH_ITEMS", 20),
+		BatchWorkers:    envInt64("IMAGE_BATCH_WORKERS", int64(runtime.GOMAXPROCS(0))),
+	}
+}
+
+// envInt64 reads a positive integer from the environment variable name
+func envInt64(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %d", name, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// Machine-readable codes of the errors returned for rejected images
+const (
+	errorCodeRequestTooLarge = "request_too_large"
+	errorCodeImageTooLarge   = "image_too_large"
+	errorCodeTooManyPixels   = "too_many_pixels"
+	errorCodeInvalidImage    = "invalid_image"
+	errorCodeInvalidRequest  = "invalid_request"
+	errorCodeProcessing      = "processing_failed"
+)
+
+// imageError is an image rejection that maps to a specific HTTP status and code
+type imageError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *imageError) Error() string {
+	return e.Message
+}
+
+// limitRequestBody caps the request body of the image routes at the configured size
+func limitRequestBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limits.MaxBodyBytes)
+		c.Next()
+	}
+}
+
+// requestBodyError turns errors caused by an oversized request body into an
+// imageError and passes every other error through unchanged
+func requestBodyError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &imageError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    errorCodeRequestTooLarge,
+			Message: fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit),
+		}
+	}
+	return err
+}
+
+// checkImageSize rejects images whose encoded size or declared dimensions exceed
+// the limits. Only the image header is parsed, so oversized images are refused
+// before any pixel memory is allocated
+func checkImageSize(data []byte) error {
+	if int64(len(data)) > limits.MaxEncodedBytes {
+		return &imageError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    errorCodeImageTooLarge,
+			Message: fmt.Sprintf("encoded image is %d bytes, the limit is %d", len(data), limits.MaxEncodedBytes),
+		}
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return &imageError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    errorCodeInvalidImage,
+			Message: fmt.Sprintf("unable to read image: %v", err),
+		}
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if config.Width <= 0 || config.Height <= 0 || pixels > limits.MaxPixels {
+		return &imageError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    errorCodeTooManyPixels,
+			Message: fmt.Sprintf("image is %dx%d pixels, the limit is %d pixels", config.Width, config.Height, limits.MaxPixels),
+		}
+	}
+	return nil
+}
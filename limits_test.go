@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// limitsRouter serves the contrast routes behind the body size limit, as main does
+func limitsRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/adjust-contrast", limitRequestBody(), adjustContrastHandler)
+	router.POST("/adjust-contrast/batch", limitRequestBody(), batchContrastHandler)
+	return router
+}
+
+// hugePNG is the start of a PNG file whose header declares width x height pixels
+// No pixel data follows, the header alone has to be enough to refuse it
+func hugePNG(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8], ihdr[9] = 8, 2 // 8-bit truecolor
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	data = append(data, chunk...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(chunk))
+}
+
+// postJSON sends body to path and returns the status and the decoded response
+func postJSON(t *testing.T, router *gin.Engine, path string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data)))
+	var response map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response
+}
+
+func TestImageLimits(t *testing.T) {
+	original := limits
+	defer func() { limits = original }()
+	router := limitsRouter()
+	contrast := func(imageData string) ContrastRequest {
+		req := ContrastRequest{ImageData: imageData}
+		req.ContrastFactor = 1.5
+		return req
+	}
+	huge := dataURIHeader("image/png") + "," + base64.StdEncoding.EncodeToString(hugePNG(100000, 100000))
+
+	tests := []struct {
+		name   string
+		limit  func(*imageLimits)
+		path   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{
+			"body over the limit", func(l *imageLimits) { l.MaxBodyBytes = 1024 },
+			"/adjust-contrast", contrast("data:image/png;base64," + strings.Repeat("A", 2048)),
+			http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge,
+		},
+		{
+			"batch body over the limit", func(l *imageLimits) { l.MaxBodyBytes = 1024 },
+			"/adjust-contrast/batch", BatchContrastRequest{Items: []ContrastRequest{contrast("data:image/png;base64," + strings.Repeat("A", 2048))}},
+			http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge,
+		},
+		{
+			"encoded image over the limit", func(l *imageLimits) { l.MaxEncodedBytes = 100 },
+			"/adjust-contrast", contrast(pngDataURI(t)),
+			http.StatusRequestEntityTooLarge, errorCodeImageTooLarge,
+		},
+		{
+			"too many pixels", func(l *imageLimits) { l.MaxPixels = 32*24 - 1 },
+			"/adjust-contrast", contrast(pngDataURI(t)),
+			http.StatusUnprocessableEntity, errorCodeTooManyPixels,
+		},
+		{
+			"decompression bomb", func(*imageLimits) {},
+			"/adjust-contrast", contrast(huge),
+			http.StatusUnprocessableEntity, errorCodeTooManyPixels,
+		},
+		{
+			"too many batch items", func(l *imageLimits) { l.MaxBatchItems = 2 },
+			"/adjust-contrast/batch", BatchContrastRequest{Items: []ContrastRequest{contrast(pngDataURI(t)), contrast(pngDataURI(t)), contrast(pngDataURI(t))}},
+			http.StatusRequestEntityTooLarge, errorCodeRequestTooLarge,
+		},
+		{
+			"within the limits", func(l *imageLimits) { l.MaxPixels, l.MaxBatchItems = 32*24, 3 },
+			"/adjust-contrast/batch", BatchContrastRequest{Items: []ContrastRequest{contrast(pngDataURI(t)), contrast(pngDataURI(t)), contrast(pngDataURI(t))}},
+			http.StatusOK, "",
+		},
+	}
+	for _, tt := range tests {
+		limits = original
+		tt.limit(&limits)
+		status, response := postJSON(t, router, tt.path, tt.body)
+		if status != tt.status {
+			t.Errorf("%s: got status %d, want %d: %v", tt.name, status, tt.status, response)
+			continue
+		}
+		if code, _ := response["code"].(string); code != tt.code {
+			t.Errorf("%s: got code %q, want %q", tt.name, code, tt.code)
+		}
+	}
+
+	// Items of a batch are checked one by one
+	limits = original
+	limits.MaxPixels = 32*24 - 1
+	status, response := postJSON(t, router, "/adjust-contrast/batch", BatchContrastRequest{Items: []ContrastRequest{contrast(pngDataURI(t))}})
+	results, _ := response["results"].([]interface{})
+	if status != http.StatusOK || len(results) != 1 {
+		t.Fatalf("batch item over the pixel limit: got status %d and %v", status, response)
+	}
+	if item := results[0].(map[string]interface{}); item["status"] != float64(http.StatusUnprocessableEntity) || item["code"] != errorCodeTooManyPixels {
+		t.Errorf("batch item over the pixel limit: got %v, want a %d %s", item, http.StatusUnprocessableEntity, errorCodeTooManyPixels)
+	}
+}
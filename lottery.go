@@ -1130,7 +1130,7 @@ func parseMegaMillionsPrizeData(detailedData *DetailedDrawData, playDate string)
 					if cashVal >= 1000000 {
 						cashValue = fmt.Sprintf("$%.1f Million", float64(cashVal)/1000000)
 					} else if cashVal >= 1000 {
-						cashValue = fmt.Sprintf("$%.0f Thousand", cashVal/1000)
+						cashValue = fmt.Sprintf("$%d Thousand", cashVal/1000)
 					} else {
 						cashValue = fmt.Sprintf("$%d", cashVal)
 					}
@@ -1362,7 +1362,7 @@ type TicketResult struct {
 // demonstratePowerballPrizes demonstrates the Powerball prize calculation system
 // This function shows examples of different ticket combinations and their prizes
 func demonstratePowerballPrizes() {
-	fmt.Println("=== Powerball Prize Calculation Examples ===\n")
+	fmt.Print("=== Powerball Prize Calculation Examples ===\n\n")
 
 	// Example winning numbers (you can change these)
 	winningNumbers := &WinningNumbers{
@@ -1433,7 +1433,7 @@ func demonstratePowerballPrizes() {
 	}
 
 	// Demonstrate Power Play multipliers
-	fmt.Println("=== Power Play Multiplier Examples ===\n")
+	fmt.Print("=== Power Play Multiplier Examples ===\n\n")
 
 	// Test a $100 prize with different multipliers
 	basePrize := 10000 // $100 in cents
@@ -1,21 +1,65 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	// Offline image processing runs without the server
+	if len(os.Args) > 1 && os.Args[1] == "process" {
+		os.Exit(runProcessCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	// Test the Powerball prize calculation system
 	fmt.Println("Testing Powerball Prize Calculation System...")
 	testPowerballPrizes()
 
+	// Uploads are recorded in the file named by IMAGE_HASH_INDEX_PATH, keeping the
+	// newest IMAGE_HASH_INDEX_SIZE of them
+	hashIndex = loadHashIndex(envString("IMAGE_HASH_INDEX_PATH", "image_hashes.json"), int(envInt64("IMAGE_HASH_INDEX_SIZE", defaultHashIndexSize)))
+
 	router := gin.Default()
 
 	// Existing contrast adjustment route
-	router.POST("/adjust-contrast", adjustContrastHandler)
+	router.POST("/adjust-contrast", limitRequestBody(), adjustContrastHandler)
+
+	// Batch contrast adjustment route
+	router.POST("/adjust-contrast/batch", limitRequestBody(), batchContrastHandler)
+
+	// Image processing pipeline route
+	router.POST("/process-image", limitRequestBody(), processImagePipelineHandler)
+
+	// Glare removal route
+	router.POST("/remove-glare", limitRequestBody(), removeGlareHandler)
+
+	// Multi-photo fusion route
+	router.POST("/fuse-images", limitRequestBody(), fuseImagesHandler)
+
+	// Near-duplicate image lookup route
+	router.POST("/images/similar", limitRequestBody(), similarImagesHandler)
+
+	// Image quality assessment route
+	router.POST("/assess-image", limitRequestBody(), assessImageHandler)
+
+	// Lottery game classification route
+	router.POST("/classify-ticket", limitRequestBody(), classifyTicketHandler)
+
+	// Local ticket reading route
+	router.POST("/read-ticket", limitRequestBody(), readTicketHandler)
 
 	// New lottery winning numbers route
 	router.POST("/lottery-winning-numbers", lotteryWinningNumbersHandler)
@@ -30,10 +74,10 @@ func main() {
 	router.GET("/megamillions-demo", megaMillionsDemoHandler)
 
 	// New Powerball ticket checking route
-	router.POST("/check-powerball-ticket", checkPowerballTicketHandler)
+	router.POST("/check-powerball-ticket", limitRequestBody(), checkPowerballTicketHandler)
 
 	// New Mega Millions ticket checking route
-	router.POST("/check-megamillions-ticket", checkMegaMillionsTicketHandler)
+	router.POST("/check-megamillions-ticket", limitRequestBody(), checkMegaMillionsTicketHandler)
 
 	// Add a simple health check route
 	router.GET("/health", func(c *gin.Context) {
@@ -44,20 +88,665 @@ func main() {
 }
 
 // adjustContrastHandler handles contrast adjustment requests
+// The image can be sent as a JSON data URI, a multipart file upload or a raw
+// application/octet-stream body. An Accept header of image/png or image/jpeg
+// returns the encoded image directly instead of a JSON data URI
 func adjustContrastHandler(c *gin.Context) {
-	var req ContrastRequest
+	upload, err := readContrastUpload(c)
+	if err != nil {
+		respondImageError(c, http.StatusBadRequest, requestBodyError(err))
+		return
+	}
+
+	acceptedType := acceptedImageType(c.GetHeader("Accept"))
+	processed, response, err := adjustContrast(upload.Data, upload.Options, strings.TrimPrefix(acceptedType, "image/"))
+	if err != nil {
+		respondImageError(c, http.StatusInternalServerError, err)
+		return
+	}
+	markDuplicate(&response, processed.Source)
+
+	if acceptedType != "" {
+		// Raw image responses carry the step results in headers
+		c.Header("X-Image-Width", strconv.Itoa(response.Width))
+		c.Header("X-Image-Height", strconv.Itoa(response.Height))
+		if response.DeskewAngle != nil {
+			c.Header("X-Deskew-Angle", strconv.FormatFloat(*response.DeskewAngle, 'f', -1, 64))
+		}
+		if response.RedactedRegions != nil {
+			regions, _ := json.Marshal(response.RedactedRegions)
+			c.Header("X-Redacted-Regions", string(regions))
+		}
+		if response.ImageID != "" {
+			c.Header("X-Image-Id", response.ImageID)
+		}
+		if response.DuplicateOf != nil {
+			c.Header("X-Duplicate-Of", response.DuplicateOf.ID)
+		}
+		c.Data(http.StatusOK, processed.MimeType, processed.Data)
+		return
+	}
+
+	response.ProcessedImage = processed.dataURI()
+	c.JSON(http.StatusOK, response)
+}
+
+// adjustContrast runs the contrast steps described by options over the image bytes
+// and fills in the response fields other than the image itself. A non-empty format
+// overrides the requested output format. Invalid options are reported as a 400 imageError
+func adjustContrast(data []byte, options ContrastOptions, format string) (*processedImage, ContrastResponse, error) {
+	steps, output, err := contrastPlan(options, format)
+	if err != nil {
+		return nil, ContrastResponse{}, err
+	}
+
+	processed, err := processImageBytes(data, output, steps)
+	if err != nil {
+		return nil, ContrastResponse{}, err
+	}
+	return processed, contrastResponse(processed), nil
+}
+
+// contrastPlan validates the contrast options and returns the steps to run and the
+// output settings. A non-empty format overrides the requested output format
+func contrastPlan(options ContrastOptions, format string) ([]pipelineStep, imageOutput, error) {
+	steps, err := contrastSteps(options)
+	if err != nil {
+		return nil, imageOutput{}, invalidRequestError(err)
+	}
+
+	output, err := newImageOutput(options.OutputOptions, options.KeepMetadata)
+	if err != nil {
+		return nil, imageOutput{}, invalidRequestError(err)
+	}
+	if options.Mode == "binarize" && output.Format == "" {
+		// Binarized images are sent as 1-bit PNGs unless the client asks otherwise
+		output.Format = "png"
+	}
+	if format != "" {
+		output.Format = format
+	}
+	return steps, output, nil
+}
+
+// contrastResponse fills in the response fields of a processed image other than
+// the image itself
+func contrastResponse(processed *processedImage) ContrastResponse {
+	response := ContrastResponse{Width: processed.Width, Height: processed.Height}
+	for _, result := range processed.Results {
+		if angle, ok := result.Details["angle"].(float64); ok && result.Name == "deskew" {
+			response.DeskewAngle = &angle
+		}
+		if regions, ok := result.Details["regions"].([]ImageRegion); ok && result.Name == "redact" {
+			response.RedactedRegions = regions
+		}
+	}
+	return response
+}
+
+// markDuplicate records the decoded upload, before any processing, in the hash
+// index and flags the response when it matches an earlier upload. Nothing is
+// recorded without an index
+func markDuplicate(response *ContrastResponse, upload image.Image) {
+	if hashIndex == nil {
+		return
+	}
+	id, match, err := hashIndex.record(perceptualHashes(upload))
+	if err != nil {
+		log.Printf("Unable to record image hash: %v", err)
+		return
+	}
+	response.ImageID = id
+	if match != nil {
+		response.Duplicate = true
+		response.DuplicateOf = &SimilarImage{ID: match.Entry.ID, Distance: match.Distance, FirstSeen: match.Entry.FirstSeen}
+	}
+}
+
+// similarImagesHandler handles requests to find earlier uploads that look like an image
+func similarImagesHandler(c *gin.Context) {
+	var req SimilarImagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondImageError(c, http.StatusBadRequest, requestBodyError(err))
+		return
+	}
+
+	algorithm := req.Algorithm
+	switch algorithm {
+	case "":
+		algorithm = "phash"
+	case "phash", "dhash":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported algorithm: %s (use phash or dhash)", req.Algorithm)})
+		return
+	}
+	maxDistance := 10
+	if req.MaxDistance != nil {
+		maxDistance = *req.MaxDistance
+	}
+	if maxDistance < 0 || maxDistance > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("max_distance must be between 0 and 64, got: %d", maxDistance)})
+		return
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = 10
+	}
+	if limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be positive, got: %d", limit)})
+		return
+	}
+
+	data, err := decodeDataURI(req.ImageData)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	img, _, _, err := decodeImage(data)
+	if err != nil {
+		respondImageError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	hashes := perceptualHashes(img)
+	response := SimilarImagesResponse{DHash: formatHash(hashes.DHash), PHash: formatHash(hashes.PHash), Matches: []SimilarImage{}}
+	if hashIndex == nil {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	for _, match := range hashIndex.find(hashes, algorithm, maxDistance) {
+		if len(response.Matches) == limit {
+			break
+		}
+		response.Matches = append(response.Matches, SimilarImage{ID: match.Entry.ID, Distance: match.Distance, FirstSeen: match.Entry.FirstSeen})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// invalidRequestError marks err as a problem with the request parameters
+func invalidRequestError(err error) error {
+	return &imageError{Status: http.StatusBadRequest, Code: errorCodeInvalidRequest, Message: err.Error()}
+}
+
+// batchContrastHandler handles requests to adjust the contrast of several images
+// Items are processed concurrently by a bounded number of workers and every item
+// gets its own result or error, so one bad image does not fail the batch
+func batchContrastHandler(c *gin.Context) {
+	var req BatchContrastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondImageError(c, http.StatusBadRequest, requestBodyError(err))
+		return
+	}
+	if int64(len(req.Items)) > limits.MaxBatchItems {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("batch has %d items, the limit is %d", len(req.Items), limits.MaxBatchItems),
+			"code":  errorCodeRequestTooLarge,
+		})
+		return
+	}
+
+	results := make([]BatchContrastResult, len(req.Items))
+	items := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(int(limits.BatchWorkers), len(req.Items)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				results[i] = safeBatchContrastItem(i, req.Items[i])
+			}
+		}()
+	}
+	for i := range req.Items {
+		items <- i
+	}
+	close(items)
+	wg.Wait()
+
+	response := BatchContrastResponse{Results: results}
+	for _, result := range results {
+		if result.Error == "" {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// processBatchItem processes a single batch item, replaceable in tests
+var processBatchItem = batchContrastItem
+
+// safeBatchContrastItem processes a batch item and turns a panic into a failed
+// result for that item. The batch workers run outside the handler goroutine, so
+// gin's recovery middleware would not catch it and the server would go down
+func safeBatchContrastItem(index int, item ContrastRequest) (result BatchContrastResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("batch item %d panicked: %v\n%s", index, r, debug.Stack())
+			err := &imageError{
+				Status:  http.StatusInternalServerError,
+				Code:    errorCodeProcessing,
+				Message: fmt.Sprintf("processing failed: %v", r),
+			}
+			result = BatchContrastResult{Index: index, Status: err.Status, Error: err.Error(), Code: err.Code}
+		}
+	}()
+	return processBatchItem(index, item)
+}
+
+// batchContrastItem processes a single item of a batch request
+func batchContrastItem(index int, item ContrastRequest) BatchContrastResult {
+	result := BatchContrastResult{Index: index, Status: http.StatusOK}
+	fail := func(err error) BatchContrastResult {
+		result.Status, result.Code = http.StatusInternalServerError, errorCodeProcessing
+		var imgErr *imageError
+		if errors.As(err, &imgErr) {
+			result.Status, result.Code = imgErr.Status, imgErr.Code
+		}
+		result.Error = err.Error()
+		return result
+	}
+
+	if item.ImageData == "" {
+		return fail(invalidRequestError(fmt.Errorf("image_data is required")))
+	}
+	data, err := decodeDataURI(item.ImageData)
+	if err != nil {
+		return fail(invalidRequestError(err))
+	}
+	processed, response, err := adjustContrast(data, item.ContrastOptions, "")
+	if err != nil {
+		return fail(err)
+	}
+	markDuplicate(&response, processed.Source)
+	response.ProcessedImage = processed.dataURI()
+	result.Result = &response
+	return result
+}
+
+// processImagePipelineHandler handles requests to run an ordered list of operations over an image
+// Every operation is validated before the image is decoded
+func processImagePipelineHandler(c *gin.Context) {
+	var req ProcessImageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondImageError(c, http.StatusBadRequest, requestBodyError(err))
+		return
+	}
+
+	steps, err := buildPipeline(req.Operations)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	output, err := newImageOutput(req.OutputOptions, false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	data, err := decodeDataURI(req.ImageData)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	start := time.Now()
+	processed, err := processImageBytes(data, output, steps)
+	if err != nil {
+		respondImageError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ProcessImageResponse{
+		ProcessedImage: processed.dataURI(),
+		Width:          processed.Width,
+		Height:         processed.Height,
+		Steps:          processed.Results,
+		TotalMs:        float64(time.Since(start).Microseconds()) / 1000,
+	})
+}
+
+// assessImageHandler handles requests to check whether a photo is good enough
+// for ticket extraction before it is uploaded for checking
+func assessImageHandler(c *gin.Context) {
+	var req AssessImageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondImageError(c, http.StatusBadRequest, requestBodyError(err))
+		return
+	}
+
+	data, err := decodeDataURI(req.ImageData)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	img, _, _, err := decodeImage(data)
+	if err != nil {
+		respondImageError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, assessImage(img))
+}
+
+// classifyTicketHandler handles requests to tell which lottery game a ticket photo belongs to
+func classifyTicketHandler(c *gin.Context) {
+	var req ClassifyTicketRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
+		respondImageError(c, http.StatusBadRequest, requestBodyError(err))
+		return
+	}
+
+	data, err := decodeDataURI(req.ImageData)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	img, _, _, err := decodeImage(data)
+	if err != nil {
+		respondImageError(c, http.StatusInternalServerError, err)
+		return
+	}
 
-	processedImage, err := processImage(req.ImageData, req.ContrastFactor)
+	c.JSON(http.StatusOK, classifyGame(img))
+}
+
+// readTicketHandler handles requests to read the play lines of a ticket photo
+// without a vision model. The optional operations prepare the photo first
+func readTicketHandler(c *gin.Context) {
+	var req ReadTicketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondImageError(c, http.StatusBadRequest, requestBodyError(err))
+		return
+	}
+
+	steps, err := buildPipeline(req.Operations)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	data, err := decodeDataURI(req.ImageData)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	img, _, _, err := decodeImage(data)
+	if err != nil {
+		respondImageError(c, http.StatusInternalServerError, err)
+		return
+	}
+	img, _, err = runPipeline(img, steps)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondImageError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, ContrastResponse{ProcessedImage: processedImage})
+	c.JSON(http.StatusOK, readTicket(img))
+}
+
+// mismatchWarningConfidence is the classifier confidence from which a ticket
+// image of another game is flagged with a warning
+const mismatchWarningConfidence = 0.8
+
+// ticketImageCheck classifies the ticket photo sent along with a ticket check and
+// compares the result with the game being checked. A mismatch is reported rather
+// than rejected, since the caller holds the ticket_type read by the vision model
+func ticketImageCheck(dataURI, game string) (gin.H, error) {
+	data, err := decodeDataURI(dataURI)
+	if err != nil {
+		return nil, err
+	}
+	img, _, _, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	classification := classifyGame(img)
+	check := gin.H{
+		"game":       classification.Game,
+		"confidence": classification.Confidence,
+		"keywords":   classification.Keywords,
+		"matches":    classification.Game == game,
+	}
+	if classification.Game != game && classification.Game != "unknown" && classification.Confidence >= mismatchWarningConfidence {
+		check["warning"] = fmt.Sprintf("ticket image looks like a %s ticket, not %s", classification.Game, game)
+	}
+	return check, nil
+}
+
+// ticketImageError responds to a ticket check whose image could not be read
+func ticketImageError(c *gin.Context, err error) {
+	status, message := http.StatusBadRequest, err.Error()
+	var imgErr *imageError
+	if errors.As(err, &imgErr) {
+		status, message = imgErr.Status, imgErr.Message
+	}
+	c.JSON(status, gin.H{
+		"success": false,
+		"error":   fmt.Sprintf("Invalid ticket image: %s", message),
+	})
+}
+
+// removeGlareHandler handles requests to remove glare from one or more photos of a ticket
+func removeGlareHandler(c *gin.Context) {
+	var req RemoveGlareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondImageError(c, http.StatusBadRequest, requestBodyError(err))
+		return
+	}
+	if len(req.Images) > maxTicketPhotos {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d images can be combined, got: %d", maxTicketPhotos, len(req.Images))})
+		return
+	}
+
+	var options GlareOptions
+	if req.Glare != nil {
+		options = *req.Glare
+	}
+	if err := options.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	output, err := newImageOutput(req.OutputOptions, false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	photos, err := decodeTicketPhotos(req.Images)
+	if err != nil {
+		respondImageError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	images := make([]image.Image, len(photos))
+	for i, photo := range photos {
+		images[i] = photo.Image
+	}
+	fused, percents, remaining := fuseGlare(images, options)
+
+	processed, err := encodeProcessed(fused, photos[0].Format, nil, output, nil)
+	if err != nil {
+		respondImageError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, RemoveGlareResponse{
+		ProcessedImage:        processed.dataURI(),
+		Width:                 processed.Width,
+		Height:                processed.Height,
+		GlarePercent:          percents,
+		RemainingGlarePercent: remaining,
+	})
+}
+
+// fuseImagesHandler handles requests to combine several photos of the same ticket
+// into one clean image, which then goes through the contrast adjustment
+func fuseImagesHandler(c *gin.Context) {
+	var req FuseImagesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondImageError(c, http.StatusBadRequest, requestBodyError(err))
+		return
+	}
+	if len(req.Images) > maxTicketPhotos {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d images can be combined, got: %d", maxTicketPhotos, len(req.Images))})
+		return
+	}
+	method := req.FusionMethod
+	switch method {
+	case "":
+		method = "sharpness"
+	case "sharpness", "median":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported fusion_method: %s", req.FusionMethod)})
+		return
+	}
+	steps, output, err := contrastPlan(req.ContrastOptions, "")
+	if err != nil {
+		respondImageError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	photos, err := decodeTicketPhotos(req.Images)
+	if err != nil {
+		respondImageError(c, http.StatusBadRequest, err)
+		return
+	}
+	images := make([]image.Image, len(photos))
+	for i, photo := range photos {
+		images[i] = photo.Image
+	}
+
+	aligned := alignPhotos(images)
+	alignments := make([]ImageAlignment, len(aligned))
+	var used []alignedPhoto
+	for i, photo := range aligned {
+		alignments[i] = ImageAlignment{OffsetX: photo.DX, OffsetY: photo.DY, Confidence: photo.Confidence}
+		if photo.Confidence >= minAlignmentConfidence {
+			alignments[i].Used = true
+			used = append(used, photo)
+		}
+	}
+
+	processed, err := processDecoded(fusePhotos(used, method), photos[0].Format, nil, output, steps)
+	if err != nil {
+		respondImageError(c, http.StatusInternalServerError, err)
+		return
+	}
+	response := FuseImagesResponse{ContrastResponse: contrastResponse(processed), Alignments: alignments}
+	// The fused image is recorded as its reference photo, which the others are aligned to
+	markDuplicate(&response.ContrastResponse, photos[0].Image)
+	response.ProcessedImage = processed.dataURI()
+	c.JSON(http.StatusOK, response)
+}
+
+// decodedPhoto is an uploaded image decoded for processing
+type decodedPhoto struct {
+	Image  image.Image
+	Format string
+}
+
+// decodeTicketPhotos decodes the data URIs of several photos of the same ticket
+// Errors name the position of the photo that could not be decoded
+func decodeTicketPhotos(dataURIs []string) ([]decodedPhoto, error) {
+	photos := make([]decodedPhoto, len(dataURIs))
+	for i, dataURI := range dataURIs {
+		data, err := decodeDataURI(dataURI)
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %w", i, err)
+		}
+		img, format, _, err := decodeImage(data)
+		if err != nil {
+			var imgErr *imageError
+			if errors.As(err, &imgErr) {
+				return nil, &imageError{Status: imgErr.Status, Code: imgErr.Code, Message: fmt.Sprintf("image %d: %s", i, imgErr.Message)}
+			}
+			return nil, fmt.Errorf("image %d: %w", i, err)
+		}
+		photos[i] = decodedPhoto{Image: img, Format: format}
+	}
+	return photos, nil
+}
+
+// respondImageError writes err as a JSON error response
+// Image rejections carry their own status and a machine-readable code, other
+// errors use the given status
+func respondImageError(c *gin.Context, status int, err error) {
+	var imgErr *imageError
+	if errors.As(err, &imgErr) {
+		c.JSON(imgErr.Status, gin.H{"error": imgErr.Message, "code": imgErr.Code})
+		return
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+// contrastUpload holds the decoded image and parameters of a contrast request
+type contrastUpload struct {
+	Data    []byte
+	Options ContrastOptions
+}
+
+// readContrastUpload reads the image and contrast options from a JSON, multipart
+// or application/octet-stream request body
+func readContrastUpload(c *gin.Context) (*contrastUpload, error) {
+	switch c.ContentType() {
+	case "multipart/form-data":
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			return nil, fmt.Errorf("missing image file: %w", err)
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		var options ContrastOptions
+		if err := c.ShouldBind(&options); err != nil {
+			return nil, err
+		}
+		return &contrastUpload{Data: data, Options: options}, nil
+
+	case "application/octet-stream":
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			return nil, err
+		}
+		var options ContrastOptions
+		if err := c.ShouldBindQuery(&options); err != nil {
+			return nil, err
+		}
+		return &contrastUpload{Data: data, Options: options}, nil
+	}
+
+	var req ContrastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return nil, err
+	}
+	data, err := decodeDataURI(req.ImageData)
+	if err != nil {
+		return nil, err
+	}
+	return &contrastUpload{Data: data, Options: req.ContrastOptions}, nil
+}
+
+// acceptedImageType returns the image type requested by the Accept header,
+// or an empty string when the client did not ask for a raw image
+func acceptedImageType(accept string) string {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		switch mediaType {
+		case "image/png", "image/jpeg":
+			return mediaType
+		}
+	}
+	return ""
 }
 
 // lotteryWinningNumbersHandler handles requests for lottery winning numbers
@@ -185,6 +874,7 @@ type PowerballTicketRequest struct {
 	PowerballNumber     int    `json:"powerball_number" binding:"required,min=1,max=26"`
 	PowerPlayMultiplier int    `json:"power_play_multiplier"`                   // 0 = no Power Play, 2,3,4,5,10 = multiplier
 	WinningNumbersDate  string `json:"winning_numbers_date" binding:"required"` // MM/DD/YYYY format
+	ImageData           string `json:"image_data"`                              // Optional ticket photo, cross-checked against the game
 }
 
 // checkPowerballTicketHandler handles requests to check Powerball tickets
@@ -220,6 +910,17 @@ func checkPowerballTicketHandler(c *gin.Context) {
 		return
 	}
 
+	// Cross-check the game against the ticket photo when one is sent along
+	var imageCheck gin.H
+	if req.ImageData != "" {
+		check, err := ticketImageCheck(req.ImageData, "powerball")
+		if err != nil {
+			ticketImageError(c, err)
+			return
+		}
+		imageCheck = check
+	}
+
 	// Get winning numbers for the specified date
 	winningNumbersResponse, err := getLotteryWinningNumbers(req.WinningNumbersDate, "powerball")
 	if err != nil {
@@ -285,6 +986,9 @@ func checkPowerballTicketHandler(c *gin.Context) {
 			"total_prize":        fmt.Sprintf("$%.2f", float64(ticketResult.TotalPrize)/100),
 		},
 	}
+	if imageCheck != nil {
+		response["image_check"] = imageCheck
+	}
 
 	c.JSON(http.StatusOK, response)
 }
@@ -296,6 +1000,7 @@ type MegaMillionsTicketRequest struct {
 	MegaBallNumber      int    `json:"mega_ball_number" binding:"required,min=1,max=25"`
 	MegaplierMultiplier int    `json:"megaplier_multiplier"`                    // 0 = no Megaplier, 2,3,4,5,10 = multiplier
 	WinningNumbersDate  string `json:"winning_numbers_date" binding:"required"` // MM/DD/YYYY format
+	ImageData           string `json:"image_data"`                              // Optional ticket photo, cross-checked against the game
 }
 
 // checkMegaMillionsTicketHandler handles requests to check Mega Millions tickets
@@ -331,6 +1036,17 @@ func checkMegaMillionsTicketHandler(c *gin.Context) {
 		return
 	}
 
+	// Cross-check the game against the ticket photo when one is sent along
+	var imageCheck gin.H
+	if req.ImageData != "" {
+		check, err := ticketImageCheck(req.ImageData, "megamillions")
+		if err != nil {
+			ticketImageError(c, err)
+			return
+		}
+		imageCheck = check
+	}
+
 	// Get winning numbers for the specified date
 	winningNumbersResponse, err := getLotteryWinningNumbers(req.WinningNumbersDate, "megamillions")
 	if err != nil {
@@ -393,6 +1109,9 @@ func checkMegaMillionsTicketHandler(c *gin.Context) {
 			"total_prize":        fmt.Sprintf("$%.2f", float64(ticketResult.TotalPrize)/100),
 		},
 	}
+	if imageCheck != nil {
+		response["image_check"] = imageCheck
+	}
 
 	c.JSON(http.StatusOK, response)
 }
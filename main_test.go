@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pngDataURI encodes a small random image as a PNG data URI
+func pngDataURI(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, randomImage(32, 24)); err != nil {
+		t.Fatal(err)
+	}
+	return dataURIHeader("image/png") + "," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestBatchContrastRecoversFromPanickingItem(t *testing.T) {
+	original := processBatchItem
+	defer func() { processBatchItem = original }()
+	processBatchItem = func(index int, item ContrastRequest) BatchContrastResult {
+		if index == 1 {
+			panic("poisoned item")
+		}
+		return original(index, item)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/adjust-contrast/batch", batchContrastHandler)
+
+	item := ContrastRequest{ImageData: pngDataURI(t)}
+	item.ContrastFactor = 1.5
+	body, _ := json.Marshal(BatchContrastRequest{Items: []ContrastRequest{item, item, item}})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/adjust-contrast/batch", bytes.NewReader(body)))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", recorder.Code, recorder.Body)
+	}
+	var response BatchContrastResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Succeeded != 2 || response.Failed != 1 {
+		t.Errorf("got %d succeeded and %d failed, want 2 and 1", response.Succeeded, response.Failed)
+	}
+	poisoned := response.Results[1]
+	if poisoned.Status != http.StatusInternalServerError || poisoned.Code != errorCodeProcessing || poisoned.Error == "" {
+		t.Errorf("poisoned item: got %+v, want a %d %s error", poisoned, http.StatusInternalServerError, errorCodeProcessing)
+	}
+	for _, i := range []int{0, 2} {
+		if result := response.Results[i]; result.Status != http.StatusOK || result.Result == nil {
+			t.Errorf("item %d: got %+v, want success", i, result)
+		}
+	}
+}
+
+func TestProcessImageRejectsMalformedDataURI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/process-image", processImagePipelineHandler)
+
+	tests := []struct {
+		imageData string
+		want      int
+	}{
+		{"data:image/png;base64,not base64!", http.StatusBadRequest},
+		{"no data URI header", http.StatusBadRequest},
+		{pngDataURI(t), http.StatusOK},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(ProcessImageRequest{ImageData: tt.imageData, Operations: []ImageOperation{{Name: "grayscale"}}})
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/process-image", bytes.NewReader(body)))
+		if recorder.Code != tt.want {
+			t.Errorf("%.30q: got status %d, want %d: %s", tt.imageData, recorder.Code, tt.want, recorder.Body)
+		}
+	}
+}
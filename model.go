@@ -1,14 +1,309 @@
 package main
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // Request payload structure for contrast adjustment
 type ContrastRequest struct {
-	ImageData      string  `json:"image_data" binding:"required"`
-	ContrastFactor float64 `json:"contrast_factor" binding:"required"`
+	ImageData string `json:"image_data" binding:"required"`
+	ContrastOptions
+}
+
+// Contrast settings shared by the JSON, multipart and raw body forms of /adjust-contrast
+type ContrastOptions struct {
+	ContrastFactor float64              `json:"contrast_factor" form:"contrast_factor"` // Required for the "linear" mode
+	Mode           string               `json:"mode" form:"mode"`                       // "linear" (default), "luminance", "sigmoid", "auto" or "binarize"
+	ColorSpace     string               `json:"color_space" form:"color_space"`         // Luminance mode: "ycbcr" (default) or "lab"
+	Sigmoid        *SigmoidOptions      `json:"sigmoid,omitempty"`                      // Settings for the "sigmoid" mode
+	Auto           *AutoContrastOptions `json:"auto,omitempty"`                         // Settings for the "auto" mode
+	Binarize       *BinarizeOptions     `json:"binarize,omitempty"`                     // Settings for the "binarize" mode
+	Deskew         bool                 `json:"deskew" form:"deskew"`                   // Straighten the text lines before adjusting contrast
+	Resize         *ResizeOptions       `json:"resize,omitempty"`                       // Resize the image before adjusting contrast
+	Glare          *GlareOptions        `json:"glare,omitempty"`                        // Remove glare before adjusting contrast
+	Flatten        *FlattenOptions      `json:"flatten,omitempty"`                      // Even out the lighting before adjusting contrast
+	Redact         *RedactOptions       `json:"redact,omitempty"`                       // Mask the barcode and serial number after adjusting contrast
+	KeepMetadata   bool                 `json:"keep_metadata" form:"keep_metadata"`     // Keep the EXIF block (GPS included) in JPEG output, stripped by default
+	OutputOptions
+}
+
+// Encoding settings for processed images
+type OutputOptions struct {
+	OutputFormat string `json:"output_format" form:"output_format"` // "png" or "jpeg", defaults to JPEG for JPEG input and PNG otherwise
+	JPEGQuality  int    `json:"jpeg_quality" form:"jpeg_quality"`   // JPEG quality from 1 to 100 (default 75)
+}
+
+// Settings for automatic contrast adjustment
+type AutoContrastOptions struct {
+	Method         string   `json:"method" form:"auto_method"`              // "equalize", "levels" or "clahe" (default)
+	LowPercentile  *float64 `json:"low_percentile" form:"low_percentile"`   // Levels: percent of pixels clipped to black (default 1, 0 for none)
+	HighPercentile float64  `json:"high_percentile" form:"high_percentile"` // Levels: percent of pixels below the white point (default 99)
+	ClipLimit      float64  `json:"clip_limit" form:"clip_limit"`           // CLAHE: histogram clip limit relative to a flat histogram (default 2)
+	TileSize       int      `json:"tile_size" form:"tile_size"`             // CLAHE: tile edge length in pixels (default 64)
+}
+
+// Settings for sigmoidal contrast adjustment
+type SigmoidOptions struct {
+	Strength float64 `json:"strength" form:"sigmoid_strength"` // Steepness of the S-curve (default 5)
+	Midpoint float64 `json:"midpoint" form:"sigmoid_midpoint"` // Tone the curve is centered on, between 0 and 1 (default 0.5)
 }
 
 // Response payload structure for contrast adjustment
 type ContrastResponse struct {
-	ProcessedImage string `json:"processed_image"`
+	ProcessedImage  string        `json:"processed_image"`
+	Width           int           `json:"width"`                      // Width of the processed image in pixels
+	Height          int           `json:"height"`                     // Height of the processed image in pixels
+	DeskewAngle     *float64      `json:"deskew_angle,omitempty"`     // Detected skew in degrees, only set when deskew was requested
+	RedactedRegions []ImageRegion `json:"redacted_regions,omitempty"` // Masked rectangles, only set when redaction was requested
+	ImageID         string        `json:"image_id,omitempty"`         // ID of the upload in the duplicate index
+	Duplicate       bool          `json:"duplicate"`                  // Set when the upload matches an earlier one
+	DuplicateOf     *SimilarImage `json:"duplicate_of,omitempty"`     // The earlier upload this one duplicates
+}
+
+// Request payload structure for near-duplicate image lookup
+type SimilarImagesRequest struct {
+	ImageData   string `json:"image_data" binding:"required"` // Base64 encoded image data
+	Algorithm   string `json:"algorithm"`                     // "phash" (default) or "dhash"
+	MaxDistance *int   `json:"max_distance"`                  // Largest Hamming distance reported, from 0 to 64 (default 10)
+	Limit       int    `json:"limit"`                         // Most matches returned (default 10)
+}
+
+// Response structure for near-duplicate image lookup
+type SimilarImagesResponse struct {
+	DHash   string         `json:"dhash"` // Hashes of the looked up image as 16 hex digits
+	PHash   string         `json:"phash"`
+	Matches []SimilarImage `json:"matches"` // Closest first
+}
+
+// Structure for an earlier upload close to an image
+type SimilarImage struct {
+	ID        string    `json:"id"`
+	Distance  int       `json:"distance"` // Hamming distance between the hashes
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// Request payload structure for batch contrast adjustment
+type BatchContrastRequest struct {
+	Items []ContrastRequest `json:"items" binding:"required,min=1"` // Each item carries its own image and contrast settings
+}
+
+// Response structure for batch contrast adjustment
+type BatchContrastResponse struct {
+	Results   []BatchContrastResult `json:"results"` // One entry per item, in request order
+	Succeeded int                   `json:"succeeded"`
+	Failed    int                   `json:"failed"`
+}
+
+// Structure for the outcome of a single batch item
+type BatchContrastResult struct {
+	Index  int               `json:"index"`
+	Status int               `json:"status"`           // HTTP status the item would have had as a single request
+	Result *ContrastResponse `json:"result,omitempty"` // Set when the item succeeded
+	Error  string            `json:"error,omitempty"`
+	Code   string            `json:"code,omitempty"` // Machine-readable error code
+}
+
+// Settings for resizing the image
+// Exactly one of scale, width/height or max_width/max_height must be set
+type ResizeOptions struct {
+	Width      int     `json:"width" form:"resize_width"`             // Target width, the height follows the aspect ratio when not set
+	Height     int     `json:"height" form:"resize_height"`           // Target height, the width follows the aspect ratio when not set
+	MaxWidth   int     `json:"max_width" form:"resize_max_width"`     // Shrink to at most this width, never enlarges
+	MaxHeight  int     `json:"max_height" form:"resize_max_height"`   // Shrink to at most this height, never enlarges
+	Scale      float64 `json:"scale" form:"resize_scale"`             // Scale factor applied to both dimensions
+	Kernel     string  `json:"kernel" form:"resize_kernel"`           // "nearest", "bilinear" or "catmull-rom" (default)
+	KeepAspect *bool   `json:"keep_aspect" form:"resize_keep_aspect"` // With both width and height, fit inside them instead of stretching (default true)
+}
+
+// Settings for illumination flattening
+type FlattenOptions struct {
+	Method string `json:"method" form:"flatten_method"` // "closing" (default) or "blur"
+	Radius int    `json:"radius" form:"flatten_radius"` // Radius of the illumination estimate in source pixels, larger than the print strokes (default 1/30 of the longest edge)
+}
+
+// Settings for glare suppression
+type GlareOptions struct {
+	Method        string   `json:"method" form:"glare_method"`                 // "inpaint" (default) or "attenuate"
+	Threshold     int      `json:"threshold" form:"glare_threshold"`           // Luma from which a colorless pixel counts as glare (default 250)
+	MaxSaturation *float64 `json:"max_saturation" form:"glare_max_saturation"` // Highest saturation of a glare pixel, from 0 to 1 (default 0.15)
+	Dilate        *int     `json:"dilate" form:"glare_dilate"`                 // Pixels the glare regions are grown by to cover their halo (default 4)
+	Strength      *float64 `json:"strength" form:"glare_strength"`             // Attenuate: share of the glare brightness removed, from 0 to 1 (default 0.8)
+}
+
+// Settings for privacy redaction of the parts of a ticket used to claim a prize
+type RedactOptions struct {
+	Detect  []string      `json:"detect" form:"redact_detect"`   // Regions to find and mask: "barcode" and "serial" (default both, [] for none)
+	Regions []ImageRegion `json:"regions"`                       // Extra rectangles to mask, in pixels of the image at this step
+	Padding int           `json:"padding" form:"redact_padding"` // Pixels added around detected regions (default 1/100 of the longest edge)
+}
+
+// Structure for a rectangle of an image
+type ImageRegion struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Kind   string `json:"kind,omitempty"` // What was found there: "barcode", "serial" or "region" for supplied rectangles
+}
+
+// Settings for play line segmentation
+type SegmentOptions struct {
+	Crops   bool `json:"crops"`   // Return every play line cut out as a PNG data URI
+	Padding int  `json:"padding"` // Pixels added around the lines (default a quarter of the text height)
+}
+
+// Structure for a play line found on a ticket
+type PlayLineSegment struct {
+	Label string `json:"label"` // Letter printed in front of the line, or assigned from A in reading order
+	ImageRegion
+	Image string `json:"image,omitempty"` // Cropped line, only set when crops were requested
+}
+
+// Request payload structure for reading a ticket without the vision model
+type ReadTicketRequest struct {
+	ImageData  string           `json:"image_data" binding:"required"`
+	Operations []ImageOperation `json:"operations,omitempty" binding:"dive"` // Pipeline operations to run before reading, such as crop_ticket or deskew
+}
+
+// Response structure for reading a ticket without the vision model
+// The fields up to multipliers follow the JSON the extraction prompt asks for
+type ReadTicketResponse struct {
+	TicketType  string         `json:"ticket_type"`  // "powerball", "megamillions", or empty when the game is unknown
+	DrawDate    string         `json:"draw_date"`    // YYYY-MM-DD, empty when no date was read
+	Numbers     [][]string     `json:"numbers"`      // Main numbers of every play line
+	PB          *[]string      `json:"pb,omitempty"` // Powerballs, only set on Powerball tickets
+	MB          *[]string      `json:"mb,omitempty"` // Mega Balls, only set on Mega Millions tickets
+	PowerPlay   bool           `json:"powerplay"`    // Power Play, or Megaplier on Mega Millions tickets
+	DoublePlay  bool           `json:"double_play"`
+	Multipliers []string       `json:"multipliers"` // Multipliers printed on the ticket, such as "3X"
+	Lines       []ReadPlayLine `json:"lines"`       // The play lines with the confidence of every number
+	Confidence  float64        `json:"confidence"`  // Confidence of the least certain digit, 0 when no play line was found
+}
+
+// Structure for a play line read off a ticket
+type ReadPlayLine struct {
+	Label string `json:"label"`
+	ImageRegion
+	Numbers []ReadNumber `json:"numbers"`
+	Ball    *ReadNumber  `json:"ball,omitempty"` // Powerball or Mega Ball
+}
+
+// Structure for a number read off a ticket
+type ReadNumber struct {
+	Value           string    `json:"value"`
+	Confidence      float64   `json:"confidence"`       // Confidence of the least certain digit, from 0 to 1
+	DigitConfidence []float64 `json:"digit_confidence"` // Confidence of every digit
+}
+
+// Request payload structure for glare removal
+// Several photos of the same ticket taken from the same position are fused,
+// taking every pixel from the photos without glare there
+type RemoveGlareRequest struct {
+	Images []string      `json:"images" binding:"required,min=1"` // Base64 encoded images
+	Glare  *GlareOptions `json:"glare,omitempty"`
+	OutputOptions
+}
+
+// Response structure for glare removal
+type RemoveGlareResponse struct {
+	ProcessedImage        string    `json:"processed_image"`
+	Width                 int       `json:"width"`
+	Height                int       `json:"height"`
+	GlarePercent          []float64 `json:"glare_percent"`           // Share of each input covered by glare
+	RemainingGlarePercent float64   `json:"remaining_glare_percent"` // Share with glare in every input, filled from the surroundings
+}
+
+// Settings for black and white conversion of the image
+type BinarizeOptions struct {
+	Method string   `json:"method" form:"binarize_method"` // "otsu" (default), "sauvola" or "niblack"
+	Window int      `json:"window" form:"window"`          // Local methods: odd window size in pixels (default 25)
+	K      *float64 `json:"k" form:"k"`                    // Local methods: threshold sensitivity (default 0.34 for Sauvola, -0.2 for Niblack)
+}
+
+// Request payload structure for the image processing pipeline
+type ProcessImageRequest struct {
+	ImageData  string           `json:"image_data" binding:"required"`
+	Operations []ImageOperation `json:"operations" binding:"required,min=1,dive"`
+	OutputOptions
+}
+
+// Structure for a single operation in the image processing pipeline
+type ImageOperation struct {
+	Name   string          `json:"name" binding:"required"` // Operation name (e.g., "grayscale", "contrast")
+	Params json.RawMessage `json:"params,omitempty"`        // Operation specific parameters
+}
+
+// Response payload structure for the image processing pipeline
+type ProcessImageResponse struct {
+	ProcessedImage string            `json:"processed_image"`
+	Width          int               `json:"width"`
+	Height         int               `json:"height"`
+	Steps          []OperationResult `json:"steps"`
+	TotalMs        float64           `json:"total_ms"`
+}
+
+// Structure for the outcome of a single pipeline operation
+type OperationResult struct {
+	Name       string                 `json:"name"`
+	DurationMs float64                `json:"duration_ms"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// Request payload structure for multi-photo fusion
+// The photos are aligned to the first one, fused into one image and then adjusted
+// with the contrast settings as in /adjust-contrast
+type FuseImagesRequest struct {
+	Images       []string `json:"images" binding:"required,min=2"` // Base64 encoded photos of the same ticket
+	FusionMethod string   `json:"fusion_method"`                   // "sharpness" (default) or "median"
+	ContrastOptions
+}
+
+// Response structure for multi-photo fusion
+type FuseImagesResponse struct {
+	ContrastResponse
+	Alignments []ImageAlignment `json:"alignments"` // One entry per input photo, in request order
+}
+
+// Structure for the registration of one photo against the first one
+type ImageAlignment struct {
+	OffsetX    float64 `json:"offset_x"`   // Horizontal shift relative to the first photo in pixels
+	OffsetY    float64 `json:"offset_y"`   // Vertical shift relative to the first photo in pixels
+	Confidence float64 `json:"confidence"` // Phase correlation peak from 0 to 1
+	Used       bool    `json:"used"`       // False when the photo could not be aligned and was left out
+}
+
+// Request payload structure for lottery game classification
+type ClassifyTicketRequest struct {
+	ImageData string `json:"image_data" binding:"required"` // Base64 encoded image data
+}
+
+// Response structure for lottery game classification
+type GameClassification struct {
+	Game        string   `json:"game"`         // "powerball", "megamillions" or "unknown" when nothing points either way
+	Confidence  float64  `json:"confidence"`   // Probability of the guess, from 0.5 to 1
+	RedPercent  float64  `json:"red_percent"`  // Share of the image in Powerball red
+	BluePercent float64  `json:"blue_percent"` // Share of the image in Mega Millions blue
+	GoldPercent float64  `json:"gold_percent"` // Share of the image in Mega Millions gold
+	Keywords    []string `json:"keywords"`     // Game words read on the ticket, such as PB or MEGAPLIER
+}
+
+// Request payload structure for image quality assessment
+type AssessImageRequest struct {
+	ImageData string `json:"image_data" binding:"required"` // Base64 encoded image data
+}
+
+// Response structure for image quality assessment
+type ImageAssessment struct {
+	Width                    int      `json:"width"`
+	Height                   int      `json:"height"`
+	BlurScore                float64  `json:"blur_score"`                 // Variance of the Laplacian, higher is sharper
+	MeanBrightness           float64  `json:"mean_brightness"`            // Average luma from 0 to 255
+	ShadowClippingPercent    float64  `json:"shadow_clipping_percent"`    // Share of pixels crushed to black
+	HighlightClippingPercent float64  `json:"highlight_clipping_percent"` // Share of pixels blown out to white
+	SkewAngle                float64  `json:"skew_angle"`                 // Text-line angle in degrees
+	Pass                     bool     `json:"pass"`
+	Reasons                  []string `json:"reasons"` // Why the photo should be retaken, empty when it passes
 }
 
 // Request payload structure for lottery winning numbers
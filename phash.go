@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// dctHashSize is the edge of the grayscale thumbnail the DCT hash is computed from
+const dctHashSize = 32
+
+// detailHashSize is the edge of the thumbnail the detail hash is computed from
+const detailHashSize = 64
+
+// Hamming distances at or below which two uploads count as the same photo
+// Tickets of the same game share their layout and only differ in the printed
+// numbers, which the 64-bit hashes are too coarse to see, so the detail hash
+// has to agree as well
+const (
+	duplicateMaxPHashDistance  = 10
+	duplicateMaxDetailDistance = detailHashSize * detailHashSize / 16
+)
+
+// imageHashes are the perceptual hashes of an image
+type imageHashes struct {
+	DHash  uint64 `json:"dhash,string"` // Difference hash over a 9x8 thumbnail
+	PHash  uint64 `json:"phash,string"` // DCT hash over a 32x32 thumbnail
+	Detail []byte `json:"detail"`       // Difference hash over a 65x64 thumbnail, one bit per pixel
+}
+
+// perceptualHashes computes the difference, DCT and detail hashes of img
+// All are computed on small grayscale thumbnails, so they survive rescaling,
+// recompression and moderate contrast changes
+func perceptualHashes(img image.Image) imageHashes {
+	return imageHashes{DHash: differenceHash(img), PHash: dctHash(img), Detail: detailHash(img)}
+}
+
+// grayThumbnail scales img to exactly width x height pixels of grayscale
+func grayThumbnail(img image.Image, width, height int) *image.Gray {
+	thumb := image.NewGray(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(thumb, thumb.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return thumb
+}
+
+// differenceHash sets one bit per pixel of a 9x8 thumbnail, for whether it is
+// brighter than its right neighbor
+func differenceHash(img image.Image) uint64 {
+	thumb := grayThumbnail(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if thumb.Pix[y*thumb.Stride+x] > thumb.Pix[y*thumb.Stride+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// detailHash is differenceHash over a detailHashSize+1 x detailHashSize thumbnail,
+// fine enough to tell apart tickets that only differ in their numbers
+func detailHash(img image.Image) []byte {
+	thumb := grayThumbnail(img, detailHashSize+1, detailHashSize)
+	hash := make([]byte, detailHashSize*detailHashSize/8)
+	for y := 0; y < detailHashSize; y++ {
+		for x := 0; x < detailHashSize; x++ {
+			if thumb.Pix[y*thumb.Stride+x] > thumb.Pix[y*thumb.Stride+x+1] {
+				bit := y*detailHashSize + x
+				hash[bit/8] |= 1 << (bit % 8)
+			}
+		}
+	}
+	return hash
+}
+
+// dctHash sets one bit per coefficient of the 8x8 lowest frequencies of the
+// discrete cosine transform of a 32x32 thumbnail, for whether it lies above their
+// median. The DC term is left out of the median since it only tracks brightness
+func dctHash(img image.Image) uint64 {
+	thumb := grayThumbnail(img, dctHashSize, dctHashSize)
+	n := dctHashSize
+
+	cosines := make([]float64, 8*n)
+	for u := 0; u < 8; u++ {
+		for x := 0; x < n; x++ {
+			cosines[u*n+x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / float64(2*n))
+		}
+	}
+
+	// The transform is separable, rows first and then columns
+	rows := make([]float64, n*8)
+	for y := 0; y < n; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < n; x++ {
+				sum += float64(thumb.Pix[y*thumb.Stride+x]) * cosines[u*n+x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+	coefficients := make([]float64, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for y := 0; y < n; y++ {
+				sum += rows[y*8+u] * cosines[v*n+y]
+			}
+			coefficients[v*8+u] = sum
+		}
+	}
+
+	sorted := append([]float64(nil), coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for _, c := range coefficients {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// hammingDistance counts the bits that differ between two hashes
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// detailDistance counts the bits that differ between two detail hashes, or
+// returns -1 when they are not the same length
+func detailDistance(a, b []byte) int {
+	if len(a) != len(b) {
+		return -1
+	}
+	distance := 0
+	for i := range a {
+		distance += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return distance
+}
+
+// imageHashEntry is an upload recorded in the hash index
+type imageHashEntry struct {
+	ID string `json:"id"`
+	imageHashes
+	FirstSeen time.Time `json:"first_seen"`
+}
+
+// imageHashIndex remembers the hashes of uploaded images so repeated uploads of
+// the same ticket photo can be recognized. Entries are kept in memory, oldest
+// first, and saved to a JSON file when a path is set. Once maxEntries uploads are
+// recorded the oldest ones are dropped
+type imageHashIndex struct {
+	mu         sync.Mutex
+	path       string
+	maxEntries int
+	entries    []imageHashEntry
+	flush      chan struct{} // Signals the saving goroutine that entries changed
+}
+
+// defaultHashIndexSize is the number of uploads the index remembers by default
+const defaultHashIndexSize = 10000
+
+// hashIndex is the index of uploads seen by the server, loaded by main. It is nil,
+// and nothing is recorded, outside the server
+var hashIndex *imageHashIndex
+
+// envString reads a string from the environment variable name
+func envString(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// loadHashIndex reads the index saved at path, keeping its maxEntries newest
+// uploads. A missing file starts an empty index and an empty path keeps the index
+// in memory only. Otherwise changes are saved by a background goroutine, so
+// recording an upload never waits for the file to be written
+func loadHashIndex(path string, maxEntries int) *imageHashIndex {
+	index := &imageHashIndex{path: path, maxEntries: maxEntries}
+	if path == "" {
+		return index
+	}
+	index.flush = make(chan struct{}, 1)
+	go index.saveLoop()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Unable to read image hash index %s: %v", path, err)
+		}
+		return index
+	}
+	if err := json.Unmarshal(data, &index.entries); err != nil {
+		log.Printf("Ignoring invalid image hash index %s: %v", path, err)
+	}
+	if len(index.entries) > maxEntries {
+		index.entries = index.entries[len(index.entries)-maxEntries:]
+	}
+	return index
+}
+
+// similarMatch is an indexed upload close to a looked up image
+type similarMatch struct {
+	Entry    imageHashEntry
+	Distance int
+}
+
+// find returns the indexed uploads within maxDistance of hashes for the given
+// algorithm ("phash" or "dhash"), closest first
+func (idx *imageHashIndex) find(hashes imageHashes, algorithm string, maxDistance int) []similarMatch {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var matches []similarMatch
+	for _, entry := range idx.entries {
+		distance := hammingDistance(entry.PHash, hashes.PHash)
+		if algorithm == "dhash" {
+			distance = hammingDistance(entry.DHash, hashes.DHash)
+		}
+		if distance <= maxDistance {
+			matches = append(matches, similarMatch{Entry: entry, Distance: distance})
+		}
+	}
+	sort.SliceStable(matches, func(a, b int) bool { return matches[a].Distance < matches[b].Distance })
+	return matches
+}
+
+// record looks hashes up as a duplicate of an earlier upload and adds them to the
+// index when they are new. It returns the ID the upload is known by, which is the
+// ID of the earlier upload for duplicates, and the matching earlier upload if any
+func (idx *imageHashIndex) record(hashes imageHashes) (string, *similarMatch, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var best *similarMatch
+	for _, entry := range idx.entries {
+		pDistance := hammingDistance(entry.PHash, hashes.PHash)
+		if pDistance > duplicateMaxPHashDistance {
+			continue
+		}
+		if distance := detailDistance(entry.Detail, hashes.Detail); distance < 0 || distance > duplicateMaxDetailDistance {
+			continue
+		}
+		if best == nil || pDistance < best.Distance {
+			best = &similarMatch{Entry: entry, Distance: pDistance}
+		}
+	}
+	if best != nil {
+		return best.Entry.ID, best, nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	entry := imageHashEntry{ID: hex.EncodeToString(id), imageHashes: hashes, FirstSeen: time.Now().UTC()}
+	if len(idx.entries) >= idx.maxEntries {
+		// Drop the oldest uploads in place, so the backing array does not grow
+		dropped := len(idx.entries) - idx.maxEntries + 1
+		idx.entries = idx.entries[:copy(idx.entries, idx.entries[dropped:])]
+	}
+	idx.entries = append(idx.entries, entry)
+	if idx.flush != nil {
+		// A save already pending picks this entry up as well
+		select {
+		case idx.flush <- struct{}{}:
+		default:
+		}
+	}
+	return entry.ID, nil, nil
+}
+
+// saveLoop writes the index to its file each time it is signaled that entries
+// changed. Changes made while a save runs are coalesced into the next one
+func (idx *imageHashIndex) saveLoop() {
+	for range idx.flush {
+		idx.mu.Lock()
+		entries := append([]imageHashEntry(nil), idx.entries...)
+		idx.mu.Unlock()
+		if err := saveHashEntries(idx.path, entries); err != nil {
+			log.Printf("Unable to save image hash index %s: %v", idx.path, err)
+		}
+	}
+}
+
+// saveHashEntries writes entries to the file at path, replacing the previous one
+// atomically
+func saveHashEntries(path string, entries []imageHashEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".image_hashes-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// formatHash renders a hash as 16 hex digits
+func formatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashIndexEvictsOldest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	index := loadHashIndex(path, 2)
+
+	// Far apart in the DCT hash, so none is taken for a duplicate of another
+	var ids []string
+	for _, hash := range []uint64{0, 0xFFFFFFFF00000000, 0x00000000FFFFFFFF} {
+		id, match, err := index.record(imageHashes{PHash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match != nil {
+			t.Fatalf("hash %016x: unexpected duplicate of %s", hash, match.Entry.ID)
+		}
+		ids = append(ids, id)
+	}
+	if len(index.entries) != 2 || index.entries[0].ID != ids[1] || index.entries[1].ID != ids[2] {
+		t.Errorf("got entries %+v, want the last two of %v", index.entries, ids)
+	}
+	if id, match, _ := index.record(imageHashes{PHash: 0xFFFFFFFF00000000}); match == nil || id != ids[1] {
+		t.Errorf("got %s, want a duplicate of %s", id, ids[1])
+	}
+
+	// The index is saved in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var saved []imageHashEntry
+		if data, err := os.ReadFile(path); err == nil {
+			json.Unmarshal(data, &saved)
+		}
+		if len(saved) == 2 && saved[1].ID == ids[2] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("saved index has %+v, want the last two of %v", saved, ids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
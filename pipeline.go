@@ -0,0 +1,901 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// imageOperationFunc applies one pipeline step to an image
+// It returns the new image along with any details worth reporting for the step
+type imageOperationFunc func(img image.Image) (image.Image, map[string]interface{}, error)
+
+// imageOperationBuilder validates the parameters of an operation and returns the step to run
+type imageOperationBuilder func(params json.RawMessage) (imageOperationFunc, error)
+
+// imageOperations is the registry of operations available to the pipeline
+var imageOperations = map[string]imageOperationBuilder{
+	"grayscale":  buildGrayscaleOperation,
+	"brightness": buildBrightnessOperation,
+	"contrast":   buildContrastOperation,
+	"gamma":      buildGammaOperation,
+	"sharpen":    buildSharpenOperation,
+
+	"auto_contrast": buildAutoContrastOperation,
+	"binarize":      buildBinarizeOperation,
+	"deskew":        buildDeskewOperation,
+	"crop_ticket":   buildCropTicketOperation,
+	"resize":        buildResizeOperation,
+
+	"flatten_illumination": buildFlattenOperation,
+	"median":               buildMedianOperation,
+	"bilateral":            buildBilateralOperation,
+	"unsharp_mask":         buildUnsharpMaskOperation,
+	"convolve":             buildConvolveOperation,
+	"luminance_contrast":   buildLuminanceContrastOperation,
+	"sigmoid_contrast":     buildSigmoidContrastOperation,
+	"remove_glare":         buildGlareOperation,
+	"redact":               buildRedactOperation,
+	"segment_lines":        buildSegmentLinesOperation,
+}
+
+// pipelineStep is a validated operation ready to run
+type pipelineStep struct {
+	name string
+	run  imageOperationFunc
+}
+
+// buildPipeline validates every requested operation before any image work starts
+func buildPipeline(operations []ImageOperation) ([]pipelineStep, error) {
+	steps := make([]pipelineStep, 0, len(operations))
+	for i, op := range operations {
+		builder, ok := imageOperations[op.Name]
+		if !ok {
+			return nil, fmt.Errorf("operation %d: unknown operation %q", i, op.Name)
+		}
+		run, err := builder(op.Params)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s): %v", i, op.Name, err)
+		}
+		steps = append(steps, pipelineStep{name: op.Name, run: run})
+	}
+	return steps, nil
+}
+
+// runPipeline applies each step in order and records how long every step took
+func runPipeline(img image.Image, steps []pipelineStep) (image.Image, []OperationResult, error) {
+	results := make([]OperationResult, 0, len(steps))
+	for _, step := range steps {
+		start := time.Now()
+		next, details, err := step.run(img)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", step.name, err)
+		}
+		img = next
+		results = append(results, OperationResult{
+			Name:       step.name,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Details:    details,
+		})
+	}
+	return img, results, nil
+}
+
+// decodeOperationParams decodes the JSON parameters of an operation into v
+// Missing parameters keep the defaults already set on v, unknown ones are rejected
+func decodeOperationParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid params: %v", err)
+	}
+	return nil
+}
+
+// contrastSteps returns the pipeline steps used by /adjust-contrast for the requested options
+func contrastSteps(options ContrastOptions) ([]pipelineStep, error) {
+	var steps []pipelineStep
+	if options.Deskew {
+		steps = append(steps, pipelineStep{name: "deskew", run: deskewOperation(defaultMaxSkewAngle)})
+	}
+	if options.Resize != nil {
+		resize := *options.Resize
+		if err := resize.validate(); err != nil {
+			return nil, err
+		}
+		steps = append(steps, pipelineStep{name: "resize", run: resizeOperation(resize)})
+	}
+	if options.Glare != nil {
+		glare := *options.Glare
+		if err := glare.validate(); err != nil {
+			return nil, err
+		}
+		steps = append(steps, pipelineStep{name: "remove_glare", run: glareOperation(glare)})
+	}
+	if options.Flatten != nil {
+		flatten := *options.Flatten
+		if err := flatten.validate(); err != nil {
+			return nil, err
+		}
+		steps = append(steps, pipelineStep{name: "flatten_illumination", run: flattenOperation(flatten)})
+	}
+
+	modeStep, err := contrastModeStep(options)
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, modeStep)
+
+	// Redaction runs last so the reported regions match the returned image
+	if options.Redact != nil {
+		redact := *options.Redact
+		if err := redact.validate(); err != nil {
+			return nil, err
+		}
+		steps = append(steps, pipelineStep{name: "redact", run: redactOperation(redact)})
+	}
+	return steps, nil
+}
+
+// contrastModeStep returns the pipeline step for the requested contrast mode
+func contrastModeStep(options ContrastOptions) (pipelineStep, error) {
+	switch options.Mode {
+	case "", "linear":
+		if err := checkContrastFactor(options.ContrastFactor); err != nil {
+			return pipelineStep{}, err
+		}
+		return pipelineStep{name: "contrast", run: contrastOperation(options.ContrastFactor)}, nil
+	case "luminance":
+		if err := checkContrastFactor(options.ContrastFactor); err != nil {
+			return pipelineStep{}, err
+		}
+		space, err := luminanceSpace(options.ColorSpace)
+		if err != nil {
+			return pipelineStep{}, err
+		}
+		return pipelineStep{name: "luminance_contrast", run: luminanceContrastOperation(options.ContrastFactor, space)}, nil
+	case "sigmoid":
+		var sigmoid SigmoidOptions
+		if options.Sigmoid != nil {
+			sigmoid = *options.Sigmoid
+		}
+		if err := sigmoid.validate(); err != nil {
+			return pipelineStep{}, err
+		}
+		return pipelineStep{name: "sigmoid_contrast", run: sigmoidContrastOperation(sigmoid)}, nil
+	case "auto":
+		var auto AutoContrastOptions
+		if options.Auto != nil {
+			auto = *options.Auto
+		}
+		if err := auto.validate(); err != nil {
+			return pipelineStep{}, err
+		}
+		return pipelineStep{name: "auto_contrast", run: autoContrastOperation(auto)}, nil
+	case "binarize":
+		var binarize BinarizeOptions
+		if options.Binarize != nil {
+			binarize = *options.Binarize
+		}
+		if err := binarize.validate(); err != nil {
+			return pipelineStep{}, err
+		}
+		return pipelineStep{name: "binarize", run: binarizeOperation(binarize)}, nil
+	}
+	return pipelineStep{}, fmt.Errorf("unsupported contrast mode: %s", options.Mode)
+}
+
+// checkContrastFactor checks the contrast_factor of the linear and luminance
+// modes, which is required and must be positive
+func checkContrastFactor(factor float64) error {
+	if factor == 0 {
+		return fmt.Errorf("contrast_factor is required")
+	}
+	if factor < 0 {
+		return fmt.Errorf("contrast_factor must not be negative, got: %v", factor)
+	}
+	return nil
+}
+
+// contrastOperation wraps changeContrast as a pipeline operation
+func contrastOperation(contrast float64) imageOperationFunc {
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		newImg, err := changeContrast(img, contrast)
+		return newImg, nil, err
+	}
+}
+
+// luminanceContrastOperation wraps luminanceContrast as a pipeline operation
+func luminanceContrastOperation(contrast float64, space string) imageOperationFunc {
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return luminanceContrast(img, contrast, space), nil, nil
+	}
+}
+
+// luminanceSpace validates the color space of the luminance mode, "ycbcr" by default
+func luminanceSpace(space string) (string, error) {
+	switch space {
+	case "":
+		return "ycbcr", nil
+	case "ycbcr", "lab":
+		return space, nil
+	}
+	return "", fmt.Errorf("unsupported color_space: %s (use ycbcr or lab)", space)
+}
+
+// buildLuminanceContrastOperation scales the contrast of the lightness channel only
+func buildLuminanceContrastOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var p struct {
+		Factor     *float64 `json:"factor"`
+		ColorSpace string   `json:"color_space"`
+	}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Factor == nil {
+		return nil, fmt.Errorf("factor is required")
+	}
+	if *p.Factor < 0 {
+		return nil, fmt.Errorf("factor must not be negative, got: %v", *p.Factor)
+	}
+	space, err := luminanceSpace(p.ColorSpace)
+	if err != nil {
+		return nil, err
+	}
+	return luminanceContrastOperation(*p.Factor, space), nil
+}
+
+// buildSigmoidContrastOperation applies an S-curve contrast adjustment
+func buildSigmoidContrastOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var options SigmoidOptions
+	if err := decodeOperationParams(params, &options); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return sigmoidContrastOperation(options), nil
+}
+
+// sigmoidContrastOperation remaps every channel through an S-curve
+func sigmoidContrastOperation(options SigmoidOptions) imageOperationFunc {
+	curve := sigmoidCurve(options.Strength, options.Midpoint)
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return mapChannels(img, curve), nil, nil
+	}
+}
+
+// validate fills in defaults for unset fields and checks the ranges of the others
+func (o *SigmoidOptions) validate() error {
+	if o.Strength == 0 {
+		o.Strength = 5
+	}
+	if o.Midpoint == 0 {
+		o.Midpoint = 0.5
+	}
+	if o.Strength < 0 || o.Strength > 20 {
+		return fmt.Errorf("strength must be between 0 and 20, got: %v", o.Strength)
+	}
+	if o.Midpoint <= 0 || o.Midpoint >= 1 {
+		return fmt.Errorf("midpoint must be between 0 and 1, got: %v", o.Midpoint)
+	}
+	return nil
+}
+
+// buildGrayscaleOperation converts the image to 8-bit grayscale
+func buildGrayscaleOperation(params json.RawMessage) (imageOperationFunc, error) {
+	if err := decodeOperationParams(params, &struct{}{}); err != nil {
+		return nil, err
+	}
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return toGray(img), nil, nil
+	}, nil
+}
+
+// buildBrightnessOperation shifts every channel by amount, where -1 is black and 1 is white
+func buildBrightnessOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var p struct {
+		Amount float64 `json:"amount"`
+	}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Amount < -1 || p.Amount > 1 {
+		return nil, fmt.Errorf("amount must be between -1 and 1, got: %v", p.Amount)
+	}
+	brightness := func(v float64) float64 { return v + p.Amount }
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return mapChannels(img, brightness), nil, nil
+	}, nil
+}
+
+// buildContrastOperation scales every channel around the midpoint by factor
+func buildContrastOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var p struct {
+		Factor *float64 `json:"factor"`
+	}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Factor == nil {
+		return nil, fmt.Errorf("factor is required")
+	}
+	if *p.Factor < 0 {
+		return nil, fmt.Errorf("factor must not be negative, got: %v", *p.Factor)
+	}
+	return contrastOperation(*p.Factor), nil
+}
+
+// buildGammaOperation applies gamma correction, values above 1 brighten the midtones
+func buildGammaOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var p struct {
+		Gamma *float64 `json:"gamma"`
+	}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Gamma == nil {
+		return nil, fmt.Errorf("gamma is required")
+	}
+	if *p.Gamma <= 0 {
+		return nil, fmt.Errorf("gamma must be positive, got: %v", *p.Gamma)
+	}
+	gamma := func(v float64) float64 { return math.Pow(v, 1 / *p.Gamma) }
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return mapChannels(img, gamma), nil, nil
+	}, nil
+}
+
+// buildSharpenOperation sharpens the image with a Laplacian kernel
+func buildSharpenOperation(params json.RawMessage) (imageOperationFunc, error) {
+	p := struct {
+		Amount float64 `json:"amount"`
+	}{Amount: 1}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Amount < 0 || p.Amount > 10 {
+		return nil, fmt.Errorf("amount must be between 0 and 10, got: %v", p.Amount)
+	}
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return sharpenImage(img, p.Amount), nil, nil
+	}, nil
+}
+
+// buildAutoContrastOperation stretches the contrast from the image histogram
+func buildAutoContrastOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var options AutoContrastOptions
+	if err := decodeOperationParams(params, &options); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return autoContrastOperation(options), nil
+}
+
+// autoContrastOperation wraps autoContrast as a pipeline operation
+func autoContrastOperation(options AutoContrastOptions) imageOperationFunc {
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		newImg, details := autoContrast(img, options)
+		return newImg, details, nil
+	}
+}
+
+// maxTileSize is the largest CLAHE tile edge accepted, in pixels
+const maxTileSize = 4096
+
+// validate fills in defaults for unset fields and checks the ranges of the others
+func (o *AutoContrastOptions) validate() error {
+	if o.Method == "" {
+		o.Method = "clahe"
+	}
+	if o.LowPercentile == nil {
+		lowPercentile := 1.0
+		o.LowPercentile = &lowPercentile
+	}
+	if o.HighPercentile == 0 {
+		o.HighPercentile = 99
+	}
+	if o.ClipLimit == 0 {
+		o.ClipLimit = 2
+	}
+	if o.TileSize == 0 {
+		o.TileSize = 64
+	}
+
+	switch o.Method {
+	case "equalize", "levels", "clahe":
+	default:
+		return fmt.Errorf("unsupported auto contrast method: %s", o.Method)
+	}
+	if *o.LowPercentile < 0 || o.HighPercentile > 100 || *o.LowPercentile >= o.HighPercentile {
+		return fmt.Errorf("percentiles must satisfy 0 <= low_percentile < high_percentile <= 100")
+	}
+	if o.ClipLimit < 1 {
+		return fmt.Errorf("clip_limit must be at least 1, got: %v", o.ClipLimit)
+	}
+	if o.TileSize < 8 || o.TileSize > maxTileSize {
+		return fmt.Errorf("tile_size must be between 8 and %d, got: %d", maxTileSize, o.TileSize)
+	}
+	return nil
+}
+
+// buildBinarizeOperation converts the image to pure black and white
+func buildBinarizeOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var options BinarizeOptions
+	if err := decodeOperationParams(params, &options); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return binarizeOperation(options), nil
+}
+
+// binarizeOperation wraps binarize as a pipeline operation
+func binarizeOperation(options BinarizeOptions) imageOperationFunc {
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		newImg, details := binarize(img, options)
+		return newImg, details, nil
+	}
+}
+
+// validate fills in defaults for unset fields and checks the ranges of the others
+func (o *BinarizeOptions) validate() error {
+	if o.Method == "" {
+		o.Method = "otsu"
+	}
+	if o.Window == 0 {
+		o.Window = 25
+	}
+	switch o.Method {
+	case "otsu", "sauvola", "niblack":
+	default:
+		return fmt.Errorf("unsupported binarize method: %s", o.Method)
+	}
+	if o.Window < 3 || o.Window%2 == 0 {
+		return fmt.Errorf("window must be an odd number of at least 3, got: %d", o.Window)
+	}
+	return nil
+}
+
+// k returns the threshold sensitivity of the local methods, falling back to the
+// default of the method when unset
+func (o BinarizeOptions) k() float64 {
+	if o.K != nil {
+		return *o.K
+	}
+	if o.Method == "niblack" {
+		return -0.2
+	}
+	return 0.34
+}
+
+// defaultMaxSkewAngle is the largest skew in degrees deskew looks for by default
+const defaultMaxSkewAngle = 15
+
+// buildDeskewOperation rotates the image so its text lines are horizontal
+func buildDeskewOperation(params json.RawMessage) (imageOperationFunc, error) {
+	p := struct {
+		MaxAngle float64 `json:"max_angle"`
+	}{MaxAngle: defaultMaxSkewAngle}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.MaxAngle <= 0 || p.MaxAngle > 45 {
+		return nil, fmt.Errorf("max_angle must be greater than 0 and at most 45, got: %v", p.MaxAngle)
+	}
+	return deskewOperation(p.MaxAngle), nil
+}
+
+// deskewOperation wraps deskewImage as a pipeline operation
+func deskewOperation(maxAngle float64) imageOperationFunc {
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		newImg, angle := deskewImage(img, maxAngle)
+		return newImg, map[string]interface{}{"angle": angle}, nil
+	}
+}
+
+// buildCropTicketOperation flattens the ticket found in the image and crops away the background
+func buildCropTicketOperation(params json.RawMessage) (imageOperationFunc, error) {
+	if err := decodeOperationParams(params, &struct{}{}); err != nil {
+		return nil, err
+	}
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		newImg, corners, found := cropTicket(img)
+		details := map[string]interface{}{"found": found}
+		if found {
+			points := make([][2]float64, len(corners))
+			for i, corner := range corners {
+				points[i] = [2]float64{math.Round(corner.X*10) / 10, math.Round(corner.Y*10) / 10}
+			}
+			details["corners"] = points
+		}
+		return newImg, details, nil
+	}, nil
+}
+
+// resizeKernels maps kernel names to the interpolators of golang.org/x/image/draw
+var resizeKernels = map[string]draw.Interpolator{
+	"nearest":     draw.NearestNeighbor,
+	"bilinear":    draw.BiLinear,
+	"catmull-rom": draw.CatmullRom,
+}
+
+// buildResizeOperation scales the image to a target size
+func buildResizeOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var options ResizeOptions
+	if err := decodeOperationParams(params, &options); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return resizeOperation(options), nil
+}
+
+// resizeOperation wraps resizeImage as a pipeline operation
+func resizeOperation(options ResizeOptions) imageOperationFunc {
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		width, height := options.targetSize(img.Bounds().Dx(), img.Bounds().Dy())
+		if int64(width) > limits.MaxPixels/int64(height) {
+			return nil, nil, &imageError{
+				Status:  http.StatusUnprocessableEntity,
+				Code:    errorCodeTooManyPixels,
+				Message: fmt.Sprintf("resized image would be %dx%d pixels, the limit is %d pixels", width, height, limits.MaxPixels),
+			}
+		}
+		newImg := resizeImage(img, width, height, resizeKernels[options.Kernel])
+		return newImg, map[string]interface{}{"width": width, "height": height}, nil
+	}
+}
+
+// validate fills in defaults for unset fields and checks that exactly one way of
+// sizing the image was picked
+func (o *ResizeOptions) validate() error {
+	if o.Kernel == "" {
+		o.Kernel = "catmull-rom"
+	}
+	if _, ok := resizeKernels[o.Kernel]; !ok {
+		return fmt.Errorf("unsupported resize kernel: %s", o.Kernel)
+	}
+	if o.KeepAspect == nil {
+		keepAspect := true
+		o.KeepAspect = &keepAspect
+	}
+
+	if o.Width < 0 || o.Height < 0 || o.MaxWidth < 0 || o.MaxHeight < 0 || o.Scale < 0 {
+		return fmt.Errorf("resize sizes must not be negative")
+	}
+	// A side longer than the pixel limit can never fit, and capping the sides
+	// keeps the size arithmetic from overflowing
+	if int64(max(o.Width, o.Height, o.MaxWidth, o.MaxHeight)) > limits.MaxPixels {
+		return fmt.Errorf("resize sizes must not exceed %d pixels", limits.MaxPixels)
+	}
+	modes := 0
+	if o.Scale > 0 {
+		modes++
+	}
+	if o.Width > 0 || o.Height > 0 {
+		modes++
+	}
+	if o.MaxWidth > 0 || o.MaxHeight > 0 {
+		modes++
+	}
+	if modes != 1 {
+		return fmt.Errorf("resize needs exactly one of scale, width/height or max_width/max_height")
+	}
+	return nil
+}
+
+// targetSize works out the resized dimensions for an image of the given size
+func (o *ResizeOptions) targetSize(width, height int) (int, int) {
+	aspect := float64(width) / float64(height)
+	fit := func(boxWidth, boxHeight float64) (int, int) {
+		scale := math.Min(boxWidth/float64(width), boxHeight/float64(height))
+		return resizeDimension(float64(width) * scale), resizeDimension(float64(height) * scale)
+	}
+
+	switch {
+	case o.Scale > 0:
+		return resizeDimension(float64(width) * o.Scale), resizeDimension(float64(height) * o.Scale)
+	case o.Width > 0 && o.Height > 0:
+		if *o.KeepAspect {
+			return fit(float64(o.Width), float64(o.Height))
+		}
+		return o.Width, o.Height
+	case o.Width > 0:
+		return o.Width, resizeDimension(float64(o.Width) / aspect)
+	case o.Height > 0:
+		return resizeDimension(float64(o.Height) * aspect), o.Height
+	}
+
+	// Only shrink to the maximum box, never enlarge
+	boxWidth, boxHeight := float64(width), float64(height)
+	if o.MaxWidth > 0 {
+		boxWidth = math.Min(boxWidth, float64(o.MaxWidth))
+	}
+	if o.MaxHeight > 0 {
+		boxHeight = math.Min(boxHeight, float64(o.MaxHeight))
+	}
+	return fit(boxWidth, boxHeight)
+}
+
+// resizeDimension rounds a computed side length to at least 1 pixel, capped just
+// past the pixel limit so that huge results are rejected instead of overflowing
+func resizeDimension(size float64) int {
+	return int(math.Max(1, math.Min(math.Round(size), float64(limits.MaxPixels+1))))
+}
+
+// buildFlattenOperation divides out uneven lighting across the image
+func buildFlattenOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var options FlattenOptions
+	if err := decodeOperationParams(params, &options); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return flattenOperation(options), nil
+}
+
+// flattenOperation wraps flattenIllumination as a pipeline operation
+func flattenOperation(options FlattenOptions) imageOperationFunc {
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return flattenIllumination(img, options), nil, nil
+	}
+}
+
+// validate fills in defaults for unset fields and checks the ranges of the others
+func (o *FlattenOptions) validate() error {
+	if o.Method == "" {
+		o.Method = "closing"
+	}
+	switch o.Method {
+	case "closing", "blur":
+	default:
+		return fmt.Errorf("unsupported flatten method: %s", o.Method)
+	}
+	if o.Radius < 0 {
+		return fmt.Errorf("radius must not be negative, got: %d", o.Radius)
+	}
+	return nil
+}
+
+// buildMedianOperation removes speckle noise with a median filter
+func buildMedianOperation(params json.RawMessage) (imageOperationFunc, error) {
+	p := struct {
+		Radius int `json:"radius"`
+	}{Radius: 1}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Radius < 1 || p.Radius > 3 {
+		return nil, fmt.Errorf("radius must be between 1 and 3, got: %d", p.Radius)
+	}
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return medianFilter(img, p.Radius), nil, nil
+	}, nil
+}
+
+// buildBilateralOperation smooths noise while keeping print edges sharp
+func buildBilateralOperation(params json.RawMessage) (imageOperationFunc, error) {
+	p := struct {
+		Radius     int     `json:"radius"`
+		SigmaColor float64 `json:"sigma_color"`
+		SigmaSpace float64 `json:"sigma_space"`
+	}{Radius: 3, SigmaColor: 25, SigmaSpace: 3}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Radius < 1 || p.Radius > 7 {
+		return nil, fmt.Errorf("radius must be between 1 and 7, got: %d", p.Radius)
+	}
+	if p.SigmaColor <= 0 || p.SigmaSpace <= 0 {
+		return nil, fmt.Errorf("sigma_color and sigma_space must be positive")
+	}
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return bilateralFilter(img, p.Radius, p.SigmaColor, p.SigmaSpace), nil, nil
+	}, nil
+}
+
+// buildUnsharpMaskOperation sharpens the image with an unsharp mask
+func buildUnsharpMaskOperation(params json.RawMessage) (imageOperationFunc, error) {
+	p := struct {
+		Radius    float64 `json:"radius"`
+		Amount    float64 `json:"amount"`
+		Threshold int     `json:"threshold"`
+	}{Radius: 1, Amount: 1}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Radius < 0.1 || p.Radius > 20 {
+		return nil, fmt.Errorf("radius must be between 0.1 and 20, got: %v", p.Radius)
+	}
+	if p.Amount < 0 || p.Amount > 10 {
+		return nil, fmt.Errorf("amount must be between 0 and 10, got: %v", p.Amount)
+	}
+	if p.Threshold < 0 || p.Threshold > 255 {
+		return nil, fmt.Errorf("threshold must be between 0 and 255, got: %d", p.Threshold)
+	}
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return unsharpMask(img, p.Radius, p.Amount, p.Threshold), nil, nil
+	}, nil
+}
+
+// buildConvolveOperation applies a caller supplied 3x3 or 5x5 kernel
+func buildConvolveOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var p struct {
+		Kernel  [][]float64 `json:"kernel"`
+		Divisor float64     `json:"divisor"`
+		Offset  float64     `json:"offset"`
+	}
+	if err := decodeOperationParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	size := len(p.Kernel)
+	if size != 3 && size != 5 {
+		return nil, fmt.Errorf("kernel must be 3x3 or 5x5")
+	}
+	kernel := make([]float64, 0, size*size)
+	sum := 0.0
+	for _, row := range p.Kernel {
+		if len(row) != size {
+			return nil, fmt.Errorf("kernel must be 3x3 or 5x5")
+		}
+		for _, weight := range row {
+			kernel = append(kernel, weight)
+			sum += weight
+		}
+	}
+
+	// Without an explicit divisor the kernel is normalized to keep the brightness,
+	// kernels that sum to zero (edge detectors) are used as they are
+	divisor := p.Divisor
+	if divisor == 0 {
+		divisor = sum
+		if math.Abs(sum) < 1e-9 {
+			divisor = 1
+		}
+	}
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		return convolveImage(img, kernel, size, divisor, p.Offset), nil, nil
+	}, nil
+}
+
+// buildGlareOperation removes specular highlights from the image
+func buildGlareOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var options GlareOptions
+	if err := decodeOperationParams(params, &options); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return glareOperation(options), nil
+}
+
+// glareOperation wraps suppressGlare as a pipeline operation
+func glareOperation(options GlareOptions) imageOperationFunc {
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		newImg, details := suppressGlare(img, options)
+		return newImg, details, nil
+	}
+}
+
+// validate fills in defaults for unset fields and checks the ranges of the others
+func (o *GlareOptions) validate() error {
+	if o.Method == "" {
+		o.Method = "inpaint"
+	}
+	if o.Threshold == 0 {
+		o.Threshold = 250
+	}
+	if o.MaxSaturation == nil {
+		maxSaturation := 0.15
+		o.MaxSaturation = &maxSaturation
+	}
+	if o.Dilate == nil {
+		dilate := 4
+		o.Dilate = &dilate
+	}
+	if o.Strength == nil {
+		strength := 0.8
+		o.Strength = &strength
+	}
+
+	switch o.Method {
+	case "inpaint", "attenuate":
+	default:
+		return fmt.Errorf("unsupported glare method: %s", o.Method)
+	}
+	if o.Threshold < 1 || o.Threshold > 255 {
+		return fmt.Errorf("threshold must be between 1 and 255, got: %d", o.Threshold)
+	}
+	if *o.MaxSaturation < 0 || *o.MaxSaturation > 1 {
+		return fmt.Errorf("max_saturation must be between 0 and 1, got: %v", *o.MaxSaturation)
+	}
+	if *o.Dilate < 0 || *o.Dilate > 50 {
+		return fmt.Errorf("dilate must be between 0 and 50, got: %d", *o.Dilate)
+	}
+	if *o.Strength < 0 || *o.Strength > 1 {
+		return fmt.Errorf("strength must be between 0 and 1, got: %v", *o.Strength)
+	}
+	return nil
+}
+
+// buildRedactOperation masks the barcode and serial number used to claim a prize
+func buildRedactOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var options RedactOptions
+	if err := decodeOperationParams(params, &options); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return redactOperation(options), nil
+}
+
+// redactOperation wraps redactImage as a pipeline operation
+// Supplied regions reaching past the image are rejected as invalid requests
+func redactOperation(options RedactOptions) imageOperationFunc {
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		width, height := img.Bounds().Dx(), img.Bounds().Dy()
+		for i, region := range options.Regions {
+			// Compared by subtraction, as x + width may overflow
+			if region.X > width || region.Width > width-region.X || region.Y > height || region.Height > height-region.Y {
+				return nil, nil, invalidRequestError(fmt.Errorf("region %d does not fit in the %dx%d image", i, width, height))
+			}
+		}
+		newImg, regions := redactImage(img, options)
+		return newImg, map[string]interface{}{"regions": regions}, nil
+	}
+}
+
+// validate checks the detections, regions and padding of the redaction
+func (o *RedactOptions) validate() error {
+	for _, detect := range o.Detect {
+		if detect != "barcode" && detect != "serial" {
+			return fmt.Errorf("unsupported redact detection: %s (use barcode or serial)", detect)
+		}
+	}
+	for i, region := range o.Regions {
+		if region.X < 0 || region.Y < 0 || region.Width <= 0 || region.Height <= 0 {
+			return fmt.Errorf("region %d: x and y must not be negative and width and height must be positive", i)
+		}
+	}
+	if o.Padding < 0 {
+		return fmt.Errorf("padding must not be negative, got: %d", o.Padding)
+	}
+	return nil
+}
+
+// buildSegmentLinesOperation finds the play lines and the draw date block of a
+// ticket. The image is passed on unchanged
+func buildSegmentLinesOperation(params json.RawMessage) (imageOperationFunc, error) {
+	var options SegmentOptions
+	if err := decodeOperationParams(params, &options); err != nil {
+		return nil, err
+	}
+	if options.Padding < 0 {
+		return nil, fmt.Errorf("padding must not be negative, got: %d", options.Padding)
+	}
+	return func(img image.Image) (image.Image, map[string]interface{}, error) {
+		lines, drawDate, err := segmentLines(img, options)
+		if err != nil {
+			return nil, nil, err
+		}
+		return img, map[string]interface{}{"lines": lines, "draw_date": drawDate}, nil
+	}, nil
+}
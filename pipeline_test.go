@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestResizeRejectsOversizedTarget(t *testing.T) {
+	// Sides past the pixel limit are rejected up front, before their product can overflow
+	for _, params := range []string{
+		`{"width": 3037000500, "height": 3037000500, "keep_aspect": false}`,
+		`{"width": 3037000500}`,
+		`{"max_height": 9223372036854775807}`,
+	} {
+		if _, err := buildResizeOperation(json.RawMessage(params)); err == nil {
+			t.Errorf("%s: expected a validation error", params)
+		}
+	}
+
+	// Sizes that only exceed the limit together, or through the image size, fail
+	// when the operation runs
+	img := randomImage(40, 30)
+	for _, params := range []string{
+		`{"width": 60000, "height": 60000, "keep_aspect": false}`,
+		`{"scale": 1e300}`,
+		`{"height": 50000}`,
+	} {
+		run, err := buildResizeOperation(json.RawMessage(params))
+		if err != nil {
+			t.Fatalf("%s: %v", params, err)
+		}
+		_, _, err = run(img)
+		var imgErr *imageError
+		if !errors.As(err, &imgErr) || imgErr.Code != errorCodeTooManyPixels {
+			t.Errorf("%s: got error %v, want %s", params, err, errorCodeTooManyPixels)
+		}
+	}
+}
+
+func TestContrastModesRejectNegativeFactor(t *testing.T) {
+	for _, mode := range []string{"linear", "luminance"} {
+		if _, err := contrastModeStep(ContrastOptions{Mode: mode, ContrastFactor: -1.5}); err == nil {
+			t.Errorf("%s: expected an error for a negative contrast_factor", mode)
+		}
+		if _, err := contrastModeStep(ContrastOptions{Mode: mode, ContrastFactor: 1.5}); err != nil {
+			t.Errorf("%s: %v", mode, err)
+		}
+	}
+	for _, name := range []string{"contrast", "luminance_contrast"} {
+		if _, err := buildPipeline([]ImageOperation{{Name: name, Params: json.RawMessage(`{"factor": -1.5}`)}}); err == nil {
+			t.Errorf("%s: expected an error for a negative factor", name)
+		}
+	}
+}
+
+func TestOptionsKeepExplicitZero(t *testing.T) {
+	var glare GlareOptions
+	if err := json.Unmarshal([]byte(`{"max_saturation": 0, "dilate": 0, "strength": 0}`), &glare); err != nil {
+		t.Fatal(err)
+	}
+	if err := glare.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if *glare.MaxSaturation != 0 || *glare.Dilate != 0 || *glare.Strength != 0 {
+		t.Errorf("glare: got max_saturation %v, dilate %v and strength %v, want zeros", *glare.MaxSaturation, *glare.Dilate, *glare.Strength)
+	}
+
+	var defaults GlareOptions
+	if err := defaults.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if *defaults.MaxSaturation != 0.15 || *defaults.Dilate != 4 || *defaults.Strength != 0.8 {
+		t.Errorf("glare: unset fields did not get their defaults")
+	}
+}
+
+func TestRedactRejectsRegionsOutsideImage(t *testing.T) {
+	if _, err := buildRedactOperation(json.RawMessage(`{"detect": [], "regions": [{"x": -5, "y": 0, "width": 10, "height": 10}]}`)); err == nil {
+		t.Error("expected a validation error for a negative x")
+	}
+
+	img := randomImage(40, 30)
+	for _, region := range []string{
+		`{"x": 10, "y": 0, "width": 9223372036854775807, "height": 5}`,
+		`{"x": 0, "y": 9223372036854775807, "width": 5, "height": 9223372036854775807}`,
+		`{"x": 30, "y": 0, "width": 11, "height": 5}`,
+		`{"x": 0, "y": 31, "width": 5, "height": 1}`,
+	} {
+		run, err := buildRedactOperation(json.RawMessage(`{"detect": [], "regions": [` + region + `]}`))
+		if err != nil {
+			t.Fatalf("%s: %v", region, err)
+		}
+		_, _, err = run(img)
+		var imgErr *imageError
+		if !errors.As(err, &imgErr) || imgErr.Status != http.StatusBadRequest {
+			t.Errorf("%s: got error %v, want a 400", region, err)
+		}
+	}
+
+	run, _ := buildRedactOperation(json.RawMessage(`{"detect": [], "regions": [{"x": 30, "y": 20, "width": 10, "height": 10}]}`))
+	_, details, err := run(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := details["regions"].([]ImageRegion); len(regions) != 1 || regions[0] != (ImageRegion{X: 30, Y: 20, Width: 10, Height: 10, Kind: "region"}) {
+		t.Errorf("got regions %+v, want the supplied one", regions)
+	}
+}
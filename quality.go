@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// assessmentAnalysisSize is the longest edge images are scaled down to before
+// sharpness and exposure are measured, so scores do not depend on resolution
+const assessmentAnalysisSize = 1000
+
+// Limits a photo has to stay within to pass the quality assessment
+const (
+	minBlurScore            = 100.0 // Variance of the Laplacian at the analysis size
+	minShortEdge            = 600   // Pixels on the shorter side of the original image
+	minMeanBrightness       = 60.0
+	maxHighlightClipPercent = 20.0
+	maxShadowClipPercent    = 40.0
+	shadowClipLevel         = 5
+	highlightClipLevel      = 250
+	maxAcceptedSkewAngle    = defaultMaxSkewAngle
+	skewSearchAngle         = 45.0
+)
+
+// assessImage measures how usable a ticket photo is for extraction and lists
+// the reasons it should be retaken, if any
+func assessImage(img image.Image) ImageAssessment {
+	bounds := img.Bounds()
+	small := scaleToFit(img, assessmentAnalysisSize, assessmentAnalysisSize, draw.ApproxBiLinear)
+	gray := toGray(small)
+
+	hist := lumaHistogram(gray, gray.Bounds())
+	pixels, sum, shadows, highlights := 0, 0, 0, 0
+	for level, count := range hist {
+		pixels += count
+		sum += level * count
+		if level <= shadowClipLevel {
+			shadows += count
+		}
+		if level >= highlightClipLevel {
+			highlights += count
+		}
+	}
+
+	assessment := ImageAssessment{
+		Width:                    bounds.Dx(),
+		Height:                   bounds.Dy(),
+		BlurScore:                roundAssessment(laplacianVariance(gray)),
+		MeanBrightness:           roundAssessment(float64(sum) / float64(pixels)),
+		ShadowClippingPercent:    roundAssessment(100 * float64(shadows) / float64(pixels)),
+		HighlightClippingPercent: roundAssessment(100 * float64(highlights) / float64(pixels)),
+		SkewAngle:                estimateSkew(img, skewSearchAngle),
+		Reasons:                  []string{},
+	}
+
+	if shortEdge := min(assessment.Width, assessment.Height); shortEdge < minShortEdge {
+		assessment.Reasons = append(assessment.Reasons,
+			fmt.Sprintf("resolution too low: shorter side is %dpx, need at least %dpx", shortEdge, minShortEdge))
+	}
+	if assessment.BlurScore < minBlurScore {
+		assessment.Reasons = append(assessment.Reasons, "image is blurry: hold the camera steady and let it focus")
+	}
+	if assessment.MeanBrightness < minMeanBrightness || assessment.ShadowClippingPercent > maxShadowClipPercent {
+		assessment.Reasons = append(assessment.Reasons, "image is underexposed: move to better light")
+	}
+	if assessment.HighlightClippingPercent > maxHighlightClipPercent {
+		assessment.Reasons = append(assessment.Reasons, "image is overexposed or has glare: avoid direct light on the ticket")
+	}
+	if math.Abs(assessment.SkewAngle) > maxAcceptedSkewAngle {
+		assessment.Reasons = append(assessment.Reasons,
+			fmt.Sprintf("ticket is tilted by %.1f degrees: hold the camera level with the ticket", assessment.SkewAngle))
+	}
+	assessment.Pass = len(assessment.Reasons) == 0
+	return assessment
+}
+
+// laplacianVariance returns the variance of the 4-neighbor Laplacian of gray,
+// which drops sharply as an image loses focus
+func laplacianVariance(gray *image.Gray) float64 {
+	bounds := gray.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 3 || height < 3 {
+		return 0
+	}
+
+	var sum, sumSquares float64
+	for y := 1; y < height-1; y++ {
+		row := gray.Pix[y*gray.Stride:]
+		above := gray.Pix[(y-1)*gray.Stride:]
+		below := gray.Pix[(y+1)*gray.Stride:]
+		for x := 1; x < width-1; x++ {
+			v := float64(int(above[x]) + int(below[x]) + int(row[x-1]) + int(row[x+1]) - 4*int(row[x]))
+			sum += v
+			sumSquares += v * v
+		}
+	}
+	n := float64((width - 2) * (height - 2))
+	mean := sum / n
+	return sumSquares/n - mean*mean
+}
+
+// roundAssessment rounds a reported measurement to two decimal places
+func roundAssessment(v float64) float64 {
+	return math.Round(v*100) / 100
+}
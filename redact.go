@@ -0,0 +1,266 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/draw"
+)
+
+// barcodeAnalysisSize is the longest edge images are scaled down to before
+// barcodes are searched for
+const barcodeAnalysisSize = 1000
+
+// Gradient conditions a pixel has to meet, after smoothing, to count as part of
+// a barcode: strong edges across the bars and at least barcodeDominance times
+// weaker edges along them. Text has edges in every direction
+const (
+	barcodeMinGradient = 60.0
+	barcodeDominance   = 3.0
+)
+
+// minBarcodeBars is the fewest bars crossed by the middle of a barcode, which
+// keeps runs of upright letters such as "ILLI" out
+const minBarcodeBars = 15
+
+// Smallest serial number strip: its words have at least minSerialGroup glyphs
+// and at least minSerialDigits digits between them
+const (
+	minSerialDigits = 10
+	minSerialGroup  = 3
+)
+
+// serialDigitShare is the share of the glyphs of a serial word that have to read
+// as digits. Terminal fonts draw 0 and O, 1 and I much alike
+const serialDigitShare = 0.75
+
+// redactImage masks the barcodes and serial numbers found in img along with the
+// given regions, and returns the masked image and every masked rectangle
+func redactImage(img image.Image, options RedactOptions) (image.Image, []ImageRegion) {
+	bounds := img.Bounds()
+	padding := options.Padding
+	if padding == 0 {
+		padding = max(2, max(bounds.Dx(), bounds.Dy())/100)
+	}
+
+	var regions []ImageRegion
+	var barcodes []image.Rectangle
+	if redactDetects(options, "barcode") {
+		barcodes = findBarcodes(img)
+		for _, rect := range barcodes {
+			regions = append(regions, imageRegion(rect.Inset(-padding).Intersect(bounds), bounds, "barcode"))
+		}
+	}
+	if redactDetects(options, "serial") {
+		for _, rect := range findSerialNumbers(img, barcodes) {
+			regions = append(regions, imageRegion(rect.Inset(-padding).Intersect(bounds), bounds, "serial"))
+		}
+	}
+	for _, region := range options.Regions {
+		rect := image.Rect(region.X, region.Y, region.X+region.Width, region.Y+region.Height).Add(bounds.Min).Intersect(bounds)
+		if !rect.Empty() {
+			regions = append(regions, imageRegion(rect, bounds, "region"))
+		}
+	}
+	if len(regions) == 0 {
+		return img, []ImageRegion{}
+	}
+
+	dst := cloneImage(img)
+	for _, region := range regions {
+		rect := image.Rect(region.X, region.Y, region.X+region.Width, region.Y+region.Height).Add(bounds.Min)
+		draw.Draw(dst, rect, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	}
+	return dst, regions
+}
+
+// redactDetects reports whether options ask for the given kind of region to be
+// detected. Both kinds are detected unless a list is given
+func redactDetects(options RedactOptions, kind string) bool {
+	if options.Detect == nil {
+		return true
+	}
+	for _, detect := range options.Detect {
+		if detect == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// imageRegion converts rect to a region relative to the image origin
+func imageRegion(rect, bounds image.Rectangle, kind string) ImageRegion {
+	rect = rect.Sub(bounds.Min)
+	return ImageRegion{X: rect.Min.X, Y: rect.Min.Y, Width: rect.Dx(), Height: rect.Dy(), Kind: kind}
+}
+
+// findBarcodes returns the rectangles of img that look like linear barcodes,
+// with bars in either orientation
+// Gradients across and along the bars are smoothed over a window of a few bars,
+// areas where one direction dominates are closed into solid blobs, and blobs
+// large and compact enough are kept
+func findBarcodes(img image.Image) []image.Rectangle {
+	bounds := img.Bounds()
+	gray := toGray(scaleToFit(img, barcodeAnalysisSize, barcodeAnalysisSize, draw.ApproxBiLinear))
+	width, height := gray.Bounds().Dx(), gray.Bounds().Dy()
+	scale := float64(bounds.Dx()) / float64(width)
+	longest := max(width, height)
+	radius := max(3, longest/150)
+
+	gx := make([]float32, width*height)
+	gy := make([]float32, width*height)
+	parallelRows(height, func(y0, y1 int) {
+		for y := max(y0, 1); y < min(y1, height-1); y++ {
+			for x := 1; x < width-1; x++ {
+				at := func(dx, dy int) float32 { return float32(gray.Pix[(y+dy)*gray.Stride+x+dx]) }
+				i := y*width + x
+				gx[i] = float32(math.Abs(float64(at(1, -1) + 2*at(1, 0) + at(1, 1) - at(-1, -1) - 2*at(-1, 0) - at(-1, 1))))
+				gy[i] = float32(math.Abs(float64(at(-1, 1) + 2*at(0, 1) + at(1, 1) - at(-1, -1) - 2*at(0, -1) - at(1, -1))))
+			}
+		}
+	})
+	boxBlur(gx, width, height, radius)
+	boxBlur(gy, width, height, radius)
+
+	var rects []image.Rectangle
+	for _, vertical := range []bool{true, false} {
+		across, along := gx, gy
+		if !vertical {
+			across, along = gy, gx
+		}
+		plane := make([]float32, width*height)
+		for i := range plane {
+			if across[i] >= barcodeMinGradient && across[i] >= barcodeDominance*along[i] {
+				plane[i] = 1
+			}
+		}
+		// Close the gaps left by wide bars, then drop what is thinner than a few bars
+		extremumFilter(plane, width, height, radius, true)
+		extremumFilter(plane, width, height, 2*radius, false)
+		extremumFilter(plane, width, height, radius, true)
+
+		mask := make([]bool, len(plane))
+		for i, v := range plane {
+			mask[i] = v > 0
+		}
+		for _, c := range connectedComponents(mask, width, height) {
+			long, short := c.Box.Dx(), c.Box.Dy()
+			if !vertical {
+				long, short = short, long
+			}
+			if long < longest/10 || short < longest/50 || float64(c.Pixels) < 0.6*float64(long*short) {
+				continue
+			}
+			if countBars(gray, c.Box, vertical) < minBarcodeBars {
+				continue
+			}
+			rects = append(rects, scaleRect(c.Box, scale).Add(bounds.Min).Intersect(bounds))
+		}
+	}
+	return rects
+}
+
+// countBars counts the dark runs along the middle of box in gray, across the
+// bars of a barcode with vertical or horizontal bars
+func countBars(gray *image.Gray, box image.Rectangle, vertical bool) int {
+	var line []uint8
+	if vertical {
+		y := (box.Min.Y + box.Max.Y) / 2
+		line = gray.Pix[y*gray.Stride+box.Min.X : y*gray.Stride+box.Max.X]
+	} else {
+		x := (box.Min.X + box.Max.X) / 2
+		for y := box.Min.Y; y < box.Max.Y; y++ {
+			line = append(line, gray.Pix[y*gray.Stride+x])
+		}
+	}
+
+	low, high := uint8(255), uint8(0)
+	for _, v := range line {
+		low, high = min(low, v), max(high, v)
+	}
+	threshold := (int(low) + int(high)) / 2
+	bars, dark := 0, false
+	for _, v := range line {
+		if int(v) < threshold && !dark {
+			bars++
+		}
+		dark = int(v) < threshold
+	}
+	return bars
+}
+
+// findSerialNumbers returns the rectangles of img holding long runs of digit
+// groups, such as the serial number printed under the barcode. Ink inside the
+// exclude rectangles is ignored
+// Play lines are not matched since their numbers come in groups of two digits
+func findSerialNumbers(img image.Image, exclude []image.Rectangle) []image.Rectangle {
+	bounds := img.Bounds()
+	layout := analyzeText(img, exclude)
+
+	var rects []image.Rectangle
+	for _, line := range layout.Lines {
+		var run image.Rectangle
+		digits := 0
+		flush := func() {
+			if digits >= minSerialDigits {
+				rects = append(rects, scaleRect(run, 1/layout.Scale).Add(bounds.Min).Intersect(bounds))
+			}
+			run, digits = image.Rectangle{}, 0
+		}
+		for _, word := range line.Words {
+			text := readWord(layout.Binary, line, word, glyphCharset)
+			wordDigits, glyphs := 0, 0
+			for _, match := range text {
+				if match.Char == '-' {
+					continue
+				}
+				glyphs++
+				if unicode.IsDigit(match.Char) || strings.ContainsRune("OI", match.Char) {
+					wordDigits++
+				}
+			}
+			if glyphs < minSerialGroup || float64(wordDigits) < serialDigitShare*float64(glyphs) {
+				flush()
+				continue
+			}
+			run = run.Union(word.Box)
+			digits += wordDigits
+		}
+		flush()
+	}
+	return rects
+}
+
+// cloneImage copies img into a new image that can be drawn on, keeping the pixel
+// format of the images the pipeline produces so the output depth is unchanged
+func cloneImage(img image.Image) draw.Image {
+	bounds := img.Bounds()
+	switch src := img.(type) {
+	case *image.Paletted:
+		dst := image.NewPaletted(bounds, src.Palette)
+		for y := 0; y < bounds.Dy(); y++ {
+			copy(dst.Pix[y*dst.Stride:y*dst.Stride+bounds.Dx()], src.Pix[y*src.Stride:])
+		}
+		return dst
+	case *image.Gray:
+		dst := image.NewGray(bounds)
+		draw.Draw(dst, bounds, src, bounds.Min, draw.Src)
+		return dst
+	case *image.Gray16:
+		dst := image.NewGray16(bounds)
+		draw.Draw(dst, bounds, src, bounds.Min, draw.Src)
+		return dst
+	case *image.NRGBA:
+		dst := image.NewNRGBA(bounds)
+		draw.Draw(dst, bounds, src, bounds.Min, draw.Src)
+		return dst
+	case *image.NRGBA64:
+		dst := image.NewNRGBA64(bounds)
+		draw.Draw(dst, bounds, src, bounds.Min, draw.Src)
+		return dst
+	}
+	return toRGBA(img)
+}
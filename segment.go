@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// minPlayNumbers is the fewest one or two digit numbers a line needs to count as
+// a play line. Powerball and Mega Millions plays have five plus the ball
+const minPlayNumbers = 5
+
+// digitsForLetters swaps letters for the digits they are mistaken for, used
+// where a number is expected
+var digitsForLetters = strings.NewReplacer("O", "0", "D", "0", "I", "1", "L", "1", "S", "5", "B", "8", "Z", "2")
+
+// datePattern matches numeric dates such as 08/27/25 or 2025-08-27
+var datePattern = regexp.MustCompile(`^(\d{1,2}[/-]\d{1,2}[/-]\d{2,4}|\d{4}-\d{1,2}-\d{1,2})$`)
+
+// drawDateWords are the words that mark the draw date block of a ticket
+var drawDateWords = []string{
+	"DRAW", "DRAWS", "DATE", "THRU",
+	"MON", "TUE", "WED", "THU", "FRI", "SAT", "SUN",
+	"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC",
+}
+
+// ticketLine is a line of text read off a ticket
+type ticketLine struct {
+	Line  textLine
+	Words [][]glyphMatch
+}
+
+// text returns the characters read in word i of the line
+func (l ticketLine) text(i int) string {
+	var text strings.Builder
+	for _, match := range l.Words[i] {
+		text.WriteRune(match.Char)
+	}
+	return text.String()
+}
+
+// ticketPlay is a play line of a ticket
+type ticketPlay struct {
+	ticketLine
+	Label string // Letter printed in front of the line, or assigned from A in reading order
+	First int    // Index of the first word after the label
+}
+
+// ticketSegments are the play lines and the draw date block found on a ticket,
+// in pixels of the analysis copy of the text layout
+type ticketSegments struct {
+	Layout    *textLayout
+	Lines     []ticketLine // Every line, read with the full charset
+	Plays     []ticketPlay
+	DrawDate  image.Rectangle
+	DateLines []ticketLine
+}
+
+// segmentTicket picks the play lines out of the text layout of a ticket, which
+// hold at least minPlayNumbers one or two digit numbers, and the draw date block,
+// the first run of lines outside the plays holding a date or draw date words
+func segmentTicket(layout *textLayout) *ticketSegments {
+	segments := &ticketSegments{Layout: layout, Lines: readTextLines(layout)}
+
+	dateStart := -1
+	for i, line := range segments.Lines {
+		if play, ok := playLine(line); ok {
+			if play.Label == "" {
+				play.Label = string(rune('A' + len(segments.Plays)))
+			}
+			segments.Plays = append(segments.Plays, play)
+			continue
+		}
+		if !drawDateLine(line) {
+			continue
+		}
+		// Only the first block of consecutive date lines is kept
+		if dateStart >= 0 && dateStart+len(segments.DateLines) != i {
+			continue
+		}
+		if dateStart < 0 {
+			dateStart = i
+		}
+		segments.DateLines = append(segments.DateLines, line)
+		segments.DrawDate = segments.DrawDate.Union(line.Line.Box)
+	}
+	return segments
+}
+
+// readTextLines reads every word of the layout with the full charset
+func readTextLines(layout *textLayout) []ticketLine {
+	lines := make([]ticketLine, len(layout.Lines))
+	for i, line := range layout.Lines {
+		lines[i].Line = line
+		for _, word := range line.Words {
+			lines[i].Words = append(lines[i].Words, readWord(layout.Binary, line, word, glyphCharset))
+		}
+	}
+	return lines
+}
+
+// playLine reports whether line reads as a play and picks out the label printed
+// in front of it, such as A in "A. 05 12 23 34 45 PB 10", when there is one
+// A short first word starting with a letter is a label when the main numbers
+// follow it in full, since labels such as "B)" may read as a number
+func playLine(line ticketLine) (ticketPlay, bool) {
+	play := ticketPlay{ticketLine: line}
+	numbers := 0
+	for i := range line.Words {
+		if isPlayNumber(line.text(i)) {
+			numbers++
+		}
+	}
+	if numbers < minPlayNumbers {
+		return play, false
+	}
+
+	first := line.text(0)
+	if len(first) > 2 || first[0] < 'A' || first[0] > 'Z' {
+		return play, true
+	}
+	following := 0
+	for i := 1; i < len(line.Words) && isPlayNumber(line.text(i)); i++ {
+		following++
+	}
+	if following >= minPlayNumbers || !isPlayNumber(first) {
+		play.Label, play.First = first[:1], 1
+	}
+	return play, true
+}
+
+// isPlayNumber reports whether text reads as a one or two digit number
+func isPlayNumber(text string) bool {
+	text = digitsForLetters.Replace(text)
+	if len(text) == 0 || len(text) > 2 {
+		return false
+	}
+	for _, r := range text {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// drawDateLine reports whether line holds a numeric date or draw date words
+func drawDateLine(line ticketLine) bool {
+	for i := range line.Words {
+		text := line.text(i)
+		if datePattern.MatchString(digitsForLetters.Replace(text)) {
+			return true
+		}
+		for _, token := range strings.FieldsFunc(lettersForDigits.Replace(text), func(r rune) bool { return r < 'A' || r > 'Z' }) {
+			for _, word := range drawDateWords {
+				if token == word || (len(word) >= 4 && editDistance(token, word) <= 1) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// segmentLines finds the play lines and the draw date block of img and returns
+// them in source pixels. With crops set every play line is also cut out of img,
+// with padding pixels around it, and encoded as a PNG data URI
+func segmentLines(img image.Image, options SegmentOptions) ([]PlayLineSegment, *ImageRegion, error) {
+	bounds := img.Bounds()
+	segments := segmentTicket(analyzeText(img, nil))
+	toSource := func(r image.Rectangle, padding int) image.Rectangle {
+		return scaleRect(r, 1/segments.Layout.Scale).Add(bounds.Min).Inset(-padding).Intersect(bounds)
+	}
+
+	padding := func(line textLine) int {
+		if options.Padding > 0 {
+			return options.Padding
+		}
+		return int(float64(line.Height)/segments.Layout.Scale) / 4
+	}
+
+	// Crops are cut out of a single RGBA copy of the image
+	var source *image.RGBA
+	if options.Crops {
+		source = toRGBA(img)
+	}
+	lines := make([]PlayLineSegment, 0, len(segments.Plays))
+	for _, play := range segments.Plays {
+		rect := toSource(play.Line.Box, padding(play.Line))
+		line := PlayLineSegment{Label: play.Label, ImageRegion: imageRegion(rect, bounds, "")}
+		if source != nil {
+			crop, err := cropDataURI(source, rect)
+			if err != nil {
+				return nil, nil, err
+			}
+			line.Image = crop
+		}
+		lines = append(lines, line)
+	}
+
+	var drawDate *ImageRegion
+	if !segments.DrawDate.Empty() {
+		region := imageRegion(toSource(segments.DrawDate, padding(segments.DateLines[0].Line)), bounds, "")
+		drawDate = &region
+	}
+	return lines, drawDate, nil
+}
+
+// cropDataURI encodes the rect part of img as a PNG data URI
+func cropDataURI(img *image.RGBA, rect image.Rectangle) (string, error) {
+	crop := img.SubImage(rect)
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, crop, "png", 0); err != nil {
+		return "", err
+	}
+	return dataURIHeader("image/png") + "," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -7,7 +7,7 @@ import (
 // testPowerballPrizes demonstrates the Powerball prize calculation system
 // This function shows examples of different ticket combinations and their prizes
 func testPowerballPrizes() {
-	fmt.Println("=== Powerball Prize Calculation Examples ===\n")
+	fmt.Print("=== Powerball Prize Calculation Examples ===\n\n")
 
 	// Example winning numbers (mock data for testing)
 	winningNumbers := &WinningNumbers{
@@ -70,7 +70,7 @@ func testPowerballPrizes() {
 	}
 
 	// Demonstrate Power Play multipliers
-	fmt.Println("=== Power Play Multiplier Examples ===\n")
+	fmt.Print("=== Power Play Multiplier Examples ===\n\n")
 
 	// Test a $100 prize with different multipliers
 	basePrize := 10000 // $100 in cents
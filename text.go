@@ -0,0 +1,230 @@
+package main
+
+import (
+	"image"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+// textAnalysisSize is the longest edge images are scaled down to before their
+// text is laid out. It is larger than the other analysis sizes so that small
+// print keeps a few pixels per stroke
+const textAnalysisSize = 2000
+
+// Glyph heights in analysis pixels that can seed a text line
+const (
+	minGlyphHeight     = 8
+	maxGlyphHeightFrac = 8 // Glyphs are at most 1/8 of the longest edge
+)
+
+// wordGapFactor is the gap between glyphs, relative to the line height, from
+// which they belong to separate words
+const wordGapFactor = 0.5
+
+// component is a connected region of marked pixels
+type component struct {
+	Box    image.Rectangle
+	Pixels int
+}
+
+// textLayout is the text found in an image, in pixels of the binarized
+// analysis copy. Scale converts source pixels to analysis pixels
+type textLayout struct {
+	Binary *image.Paletted
+	Scale  float64
+	Lines  []textLine
+}
+
+// textLine is a row of text, with its glyphs grouped into words
+type textLine struct {
+	Box    image.Rectangle
+	Height int // Median height of the full-size glyphs
+	Words  []textWord
+}
+
+// textWord is a run of glyphs without a word gap between them
+type textWord struct {
+	Box    image.Rectangle
+	Glyphs []image.Rectangle // Left to right
+}
+
+// analyzeText binarizes a copy of img and lays out its text in lines and words
+// Ink inside the exclude rectangles, given in source pixels, is ignored
+// Lines are found with a projection profile of the glyph-sized connected
+// components, so the text should run horizontally
+func analyzeText(img image.Image, exclude []image.Rectangle) *textLayout {
+	bounds := img.Bounds()
+	small := scaleToFit(img, textAnalysisSize, textAnalysisSize, draw.ApproxBiLinear)
+	scale := float64(small.Bounds().Dx()) / float64(bounds.Dx())
+	window := max(15, max(small.Bounds().Dx(), small.Bounds().Dy())/40) | 1
+	binary, _ := binarize(small, BinarizeOptions{Method: "sauvola", Window: window})
+
+	width, height := binary.Bounds().Dx(), binary.Bounds().Dy()
+	for _, rect := range exclude {
+		r := scaleRect(rect.Sub(bounds.Min), scale).Intersect(image.Rect(0, 0, width, height))
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				binary.Pix[y*binary.Stride+x] = 1
+			}
+		}
+	}
+
+	mask := make([]bool, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mask[y*width+x] = binary.Pix[y*binary.Stride+x] == 0
+		}
+	}
+	return &textLayout{Binary: binary, Scale: scale, Lines: textLines(connectedComponents(mask, width, height), width, height)}
+}
+
+// textLines groups components into lines of text. Glyph-sized components are
+// projected onto the vertical axis and every run of covered rows becomes a line
+// Smaller components such as punctuation join the line their center falls in
+func textLines(components []component, width, height int) []textLine {
+	maxHeight := max(width, height) / maxGlyphHeightFrac
+	profile := make([]int, height)
+	var glyphs, marks []component
+	for _, c := range components {
+		h := c.Box.Dy()
+		switch {
+		case h > maxHeight || c.Box.Dx() > width/2:
+			// Borders, bands and pictures
+		case h >= minGlyphHeight && c.Box.Dx() <= 4*h:
+			glyphs = append(glyphs, c)
+			for y := c.Box.Min.Y; y < c.Box.Max.Y; y++ {
+				profile[y]++
+			}
+		case c.Pixels >= 2:
+			marks = append(marks, c)
+		}
+	}
+
+	var lines []textLine
+	var boxes [][]image.Rectangle
+	for y := 0; y < height; {
+		if profile[y] == 0 {
+			y++
+			continue
+		}
+		top := y
+		for y < height && profile[y] > 0 {
+			y++
+		}
+		lines = append(lines, textLine{Box: image.Rect(0, top, width, y)})
+		boxes = append(boxes, nil)
+	}
+	lineAt := func(c component) int {
+		center := (c.Box.Min.Y + c.Box.Max.Y) / 2
+		i := sort.Search(len(lines), func(i int) bool { return lines[i].Box.Max.Y > center })
+		if i < len(lines) && lines[i].Box.Min.Y <= center {
+			return i
+		}
+		return -1
+	}
+	for _, c := range glyphs {
+		if i := lineAt(c); i >= 0 {
+			boxes[i] = append(boxes[i], c.Box)
+		}
+	}
+	for _, c := range marks {
+		if i := lineAt(c); i >= 0 {
+			boxes[i] = append(boxes[i], c.Box)
+		}
+	}
+
+	for i := range lines {
+		glyphBoxes := mergeGlyphs(boxes[i])
+		var heights []int
+		for _, box := range glyphBoxes {
+			if box.Dy() >= minGlyphHeight {
+				heights = append(heights, box.Dy())
+			}
+		}
+		sort.Ints(heights)
+		lines[i].Height = heights[len(heights)/2]
+		lines[i].Box = image.Rectangle{}
+		for _, box := range glyphBoxes {
+			lines[i].Box = lines[i].Box.Union(box)
+		}
+		lines[i].Words = splitWords(glyphBoxes, float64(lines[i].Height)*wordGapFactor)
+	}
+	return lines
+}
+
+// mergeGlyphs sorts the boxes of a line from left to right and merges boxes that
+// overlap horizontally by more than half of the narrower one, which joins dots,
+// colons and broken strokes into a single glyph
+func mergeGlyphs(boxes []image.Rectangle) []image.Rectangle {
+	sort.Slice(boxes, func(a, b int) bool { return boxes[a].Min.X < boxes[b].Min.X })
+	var merged []image.Rectangle
+	for _, box := range boxes {
+		if n := len(merged); n > 0 {
+			last := merged[n-1]
+			overlap := min(last.Max.X, box.Max.X) - max(last.Min.X, box.Min.X)
+			if 2*overlap > min(last.Dx(), box.Dx()) {
+				merged[n-1] = last.Union(box)
+				continue
+			}
+		}
+		merged = append(merged, box)
+	}
+	return merged
+}
+
+// splitWords groups the glyphs of a line into words wherever the gap between
+// neighbors exceeds gap pixels
+func splitWords(glyphs []image.Rectangle, gap float64) []textWord {
+	var words []textWord
+	for i, box := range glyphs {
+		if i == 0 || float64(box.Min.X-glyphs[i-1].Max.X) > gap {
+			words = append(words, textWord{Box: box})
+		}
+		word := &words[len(words)-1]
+		word.Box = word.Box.Union(box)
+		word.Glyphs = append(word.Glyphs, box)
+	}
+	return words
+}
+
+// connectedComponents labels the 8-connected regions of mask and returns their
+// bounding boxes and pixel counts
+func connectedComponents(mask []bool, width, height int) []component {
+	visited := make([]bool, len(mask))
+	var components []component
+	stack := make([]int, 0, 1024)
+	for start, set := range mask {
+		if !set || visited[start] {
+			continue
+		}
+		visited[start] = true
+		stack = append(stack[:0], start)
+		x0, y0, x1, y1, pixels := width, height, 0, 0, 0
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			pixels++
+			x, y := i%width, i/width
+			x0, y0, x1, y1 = min(x0, x), min(y0, y), max(x1, x+1), max(y1, y+1)
+			for ny := max(y-1, 0); ny <= min(y+1, height-1); ny++ {
+				for nx := max(x-1, 0); nx <= min(x+1, width-1); nx++ {
+					if n := ny*width + nx; mask[n] && !visited[n] {
+						visited[n] = true
+						stack = append(stack, n)
+					}
+				}
+			}
+		}
+		components = append(components, component{Box: image.Rect(x0, y0, x1, y1), Pixels: pixels})
+	}
+	return components
+}
+
+// scaleRect multiplies the coordinates of r by scale, rounding outwards
+func scaleRect(r image.Rectangle, scale float64) image.Rectangle {
+	return image.Rect(
+		int(float64(r.Min.X)*scale), int(float64(r.Min.Y)*scale),
+		int(float64(r.Max.X)*scale+0.999), int(float64(r.Max.Y)*scale+0.999),
+	)
+}
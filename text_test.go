@@ -0,0 +1,100 @@
+package main
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestMergeGlyphs(t *testing.T) {
+	tests := []struct {
+		name  string
+		boxes []image.Rectangle
+		want  []image.Rectangle
+	}{
+		{"empty", nil, nil},
+		{
+			"sorted left to right",
+			[]image.Rectangle{image.Rect(30, 0, 40, 10), image.Rect(0, 0, 10, 10)},
+			[]image.Rectangle{image.Rect(0, 0, 10, 10), image.Rect(30, 0, 40, 10)},
+		},
+		{
+			"broken stroke",
+			[]image.Rectangle{image.Rect(0, 0, 10, 5), image.Rect(1, 5, 9, 10)},
+			[]image.Rectangle{image.Rect(0, 0, 10, 10)},
+		},
+		{
+			"dot over a narrow glyph",
+			[]image.Rectangle{image.Rect(20, 4, 24, 20), image.Rect(21, 0, 25, 3)},
+			[]image.Rectangle{image.Rect(20, 0, 25, 20)},
+		},
+		{
+			"touching neighbors",
+			[]image.Rectangle{image.Rect(0, 0, 10, 10), image.Rect(8, 0, 20, 10)},
+			[]image.Rectangle{image.Rect(0, 0, 10, 10), image.Rect(8, 0, 20, 10)},
+		},
+	}
+	for _, tt := range tests {
+		if got := mergeGlyphs(tt.boxes); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	glyphs := []image.Rectangle{
+		image.Rect(0, 0, 10, 20),
+		image.Rect(15, 2, 25, 20), // A gap of exactly 5 stays in the word
+		image.Rect(31, 0, 41, 18),
+		image.Rect(50, 0, 60, 20),
+	}
+	want := []textWord{
+		{Box: image.Rect(0, 0, 25, 20), Glyphs: glyphs[:2]},
+		{Box: image.Rect(31, 0, 41, 18), Glyphs: glyphs[2:3]},
+		{Box: image.Rect(50, 0, 60, 20), Glyphs: glyphs[3:]},
+	}
+	if got := splitWords(glyphs, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := splitWords(nil, 5); got != nil {
+		t.Errorf("no glyphs: got %v, want no words", got)
+	}
+}
+
+func TestTextLines(t *testing.T) {
+	glyph := func(x0, y0, x1, y1 int) component {
+		return component{Box: image.Rect(x0, y0, x1, y1), Pixels: (x1 - x0) * (y1 - y0) / 2}
+	}
+	components := []component{
+		glyph(0, 0, 400, 200), // Border around the ticket
+		glyph(60, 10, 70, 30),
+		glyph(10, 10, 20, 30),
+		glyph(24, 12, 34, 30),
+		glyph(62, 12, 66, 15), // Mark inside a glyph
+		glyph(22, 62, 32, 80), // Second line, out of order
+		glyph(10, 60, 20, 76),
+		{Box: image.Rect(300, 100, 301, 101), Pixels: 1}, // Speck between the lines
+		glyph(100, 40, 104, 43),                          // Mark outside any line
+		glyph(200, 150, 300, 152),                        // Rule too flat for a glyph
+	}
+	want := []textLine{
+		{
+			Box:    image.Rect(10, 10, 70, 30),
+			Height: 20,
+			Words: []textWord{
+				{Box: image.Rect(10, 10, 34, 30), Glyphs: []image.Rectangle{image.Rect(10, 10, 20, 30), image.Rect(24, 12, 34, 30)}},
+				{Box: image.Rect(60, 10, 70, 30), Glyphs: []image.Rectangle{image.Rect(60, 10, 70, 30)}},
+			},
+		},
+		{
+			Box:    image.Rect(10, 60, 32, 80),
+			Height: 18,
+			Words: []textWord{
+				{Box: image.Rect(10, 60, 32, 80), Glyphs: []image.Rectangle{image.Rect(10, 60, 20, 76), image.Rect(22, 62, 32, 80)}},
+			},
+		},
+	}
+	if got := textLines(components, 400, 200); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}